@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.com/future-architect/gcp-instance-scheduler/schedule"
+	"github.com/future-architect/gcp-instance-scheduler/scheduler"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "daemon keeps running and executes the jobs in the config file by cron expressions",
+	Long:  `daemon keeps running and executes the jobs in the config file by cron expressions.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		projectID, slackToken, slackChannel, timeout, slackEnable, err := getFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		folders, organizations, err := getProjectFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Project ID: %v", projectID)
+		if projectID == "" && len(folders) == 0 && len(organizations) == 0 {
+			return errors.New("not found project variable")
+		}
+
+		configPath, err := cmd.PersistentFlags().GetString("config")
+		if err != nil {
+			return err
+		}
+		if configPath == "" {
+			return errors.New("not found schedule config variable")
+		}
+
+		opts := scheduler.NewOptions(projectID, slackToken, slackChannel, slackEnable)
+		opts.Folders, opts.Organizations = folders, organizations
+		if opts.Targets, opts.Excludes, err = getOperatorFlags(cmd); err != nil {
+			return err
+		}
+		if err = getRunFlags(cmd, opts); err != nil {
+			return err
+		}
+		if opts.Schedules, err = schedule.Load(configPath); err != nil {
+			return err
+		}
+		if len(opts.Schedules.Jobs) == 0 {
+			return errors.New("no job is configured")
+		}
+
+		// jobs never run at the same time
+		var mu sync.Mutex
+		// the jobs without the time zone run in UTC, not in the local time zone of the host
+		c := cron.New(cron.WithLocation(time.UTC))
+		for _, job := range opts.Schedules.Jobs {
+			job := job
+			if _, err := c.AddFunc(job.Spec(), func() {
+				mu.Lock()
+				defer mu.Unlock()
+				runJob(job, opts, time.Duration(timeout)*time.Second)
+			}); err != nil {
+				return err
+			}
+			log.Printf("Job registered: %v (%v)", job.Command, job.Spec())
+		}
+
+		c.Start()
+		log.Printf("Daemon started")
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+
+		log.Printf("Daemon stopping: wait for the running job")
+		<-c.Stop().Done()
+		return nil
+	},
+}
+
+func runJob(job *schedule.Job, opts *scheduler.Options, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Printf("Job started: %v", job.Command)
+
+	var err error
+	switch job.Command {
+	case "stop":
+		err = scheduler.Shutdown(ctx, opts)
+	case "start":
+		err = scheduler.Restart(ctx, opts)
+	case "ensure", "apply":
+		err = scheduler.Ensure(ctx, opts)
+	}
+	if err != nil {
+		log.Printf("Job failed: %v: %v", job.Command, err)
+	}
+}
+
+func init() {
+	daemonCmd.PersistentFlags().StringP("project", "p", os.Getenv("GCP_PROJECT"), "project id. comma separated for multiple projects (default $GCP_PROJECT)")
+	addProjectFlags(daemonCmd)
+	daemonCmd.PersistentFlags().StringP("slackToken", "t", os.Getenv("SLACK_API_TOKEN"), "SlackAPI token (should enable slack notify) (default $SLACK_API_TOKEN)")
+	daemonCmd.PersistentFlags().StringP("slackChannel", "c", os.Getenv("SLACK_CHANNEL"), "Slack Channel name (should enable slack notify) (default SLACK_CHANNEL)")
+	daemonCmd.PersistentFlags().BoolP("slackNotifyEnable", "s", false, "Enable slack notification")
+	daemonCmd.PersistentFlags().Int("timeout", 60, "set timeout seconds of each job")
+	daemonCmd.PersistentFlags().StringSlice("target", nil, "operator names to run (default all)")
+	daemonCmd.PersistentFlags().StringSlice("exclude", nil, "operator names not to run")
+	addRunFlags(daemonCmd)
+	daemonCmd.PersistentFlags().String("config", os.Getenv("SCHEDULE_CONFIG"), "schedule config file (default $SCHEDULE_CONFIG)")
+
+	rootCmd.AddCommand(daemonCmd)
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.com/future-architect/gcp-instance-scheduler/schedule"
+	"github.com/future-architect/gcp-instance-scheduler/scheduler"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"time"
+)
+
+var ensureCmd = &cobra.Command{
+	Use:     "ensure",
+	Aliases: []string{"apply"},
+	Short:   "ensure is execution command that converges gcp resources to the desired state of their schedules",
+	Long: `ensure is execution command that converges gcp resources to the desired state of their schedules.
+Only the resources which deviate from the desired state are stopped or started, so it is safe to run repeatedly.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		projectID, slackToken, slackChannel, timeout, slackEnable, err := getFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		folders, organizations, err := getProjectFlags(cmd)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Project ID: %v", projectID)
+		if projectID == "" && len(folders) == 0 && len(organizations) == 0 {
+			return errors.New("not found project variable")
+		}
+
+		configPath, err := cmd.PersistentFlags().GetString("config")
+		if err != nil {
+			return err
+		}
+		if configPath == "" {
+			return errors.New("not found schedule config variable")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+		defer cancel()
+
+		opts := scheduler.NewOptions(projectID, slackToken, slackChannel, slackEnable)
+		opts.Folders, opts.Organizations = folders, organizations
+		if opts.Targets, opts.Excludes, err = getOperatorFlags(cmd); err != nil {
+			return err
+		}
+		if err = getRunFlags(cmd, opts); err != nil {
+			return err
+		}
+		if opts.Schedules, err = schedule.Load(configPath); err != nil {
+			return err
+		}
+
+		return scheduler.Ensure(ctx, opts)
+	},
+}
+
+func init() {
+	ensureCmd.PersistentFlags().StringP("project", "p", os.Getenv("GCP_PROJECT"), "project id. comma separated for multiple projects (default $GCP_PROJECT)")
+	addProjectFlags(ensureCmd)
+	ensureCmd.PersistentFlags().StringP("slackToken", "t", os.Getenv("SLACK_API_TOKEN"), "SlackAPI token (should enable slack notify) (default $SLACK_API_TOKEN)")
+	ensureCmd.PersistentFlags().StringP("slackChannel", "c", os.Getenv("SLACK_CHANNEL"), "Slack Channel name (should enable slack notify) (default SLACK_CHANNEL)")
+	ensureCmd.PersistentFlags().BoolP("slackNotifyEnable", "s", false, "Enable slack notification")
+	ensureCmd.PersistentFlags().Int("timeout", 60, "set timeout seconds")
+	ensureCmd.PersistentFlags().StringSlice("target", nil, "operator names to run (default all)")
+	ensureCmd.PersistentFlags().StringSlice("exclude", nil, "operator names not to run")
+	addRunFlags(ensureCmd)
+	ensureCmd.PersistentFlags().String("config", os.Getenv("SCHEDULE_CONFIG"), "schedule config file (default $SCHEDULE_CONFIG)")
+
+	rootCmd.AddCommand(ensureCmd)
+}
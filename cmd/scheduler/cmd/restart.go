@@ -20,24 +20,46 @@ var restartCmd = &cobra.Command{
 			return err
 		}
 
+		folders, organizations, err := getProjectFlags(cmd)
+		if err != nil {
+			return err
+		}
+
 		log.Printf("Project ID: %v", projectID)
-		if projectID == "" {
+		if projectID == "" && len(folders) == 0 && len(organizations) == 0 {
 			return errors.New("not found project variable")
 		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 		defer cancel()
 
-		return scheduler.Restart(ctx, scheduler.NewOptions(projectID, slackToken, slackChannel, slackEnable))
+		opts := scheduler.NewOptions(projectID, slackToken, slackChannel, slackEnable)
+		opts.Folders, opts.Organizations = folders, organizations
+		if opts.Targets, opts.Excludes, err = getOperatorFlags(cmd); err != nil {
+			return err
+		}
+		if err = getRunFlags(cmd, opts); err != nil {
+			return err
+		}
+		if opts.Schedules, err = getScheduleConfig(cmd); err != nil {
+			return err
+		}
+
+		return scheduler.Restart(ctx, opts)
 	},
 }
 
 func init() {
-	restartCmd.PersistentFlags().StringP("project", "p", os.Getenv("GCP_PROJECT"), "project id (default $GCP_PROJECT)")
+	restartCmd.PersistentFlags().StringP("project", "p", os.Getenv("GCP_PROJECT"), "project id. comma separated for multiple projects (default $GCP_PROJECT)")
+	addProjectFlags(restartCmd)
 	restartCmd.PersistentFlags().StringP("slackToken", "t", os.Getenv("SLACK_API_TOKEN"), "SlackAPI token (should enable slack notify) (default $SLACK_API_TOKEN)")
 	restartCmd.PersistentFlags().StringP("slackChannel", "c", os.Getenv("SLACK_CHANNEL"), "Slack Channel name (should enable slack notify) (default SLACK_CHANNEL)")
 	restartCmd.PersistentFlags().BoolP("slackNotifyEnable", "s", false, "Enable slack notification")
 	restartCmd.PersistentFlags().Int("timeout", 60, "set timeout seconds")
+	restartCmd.PersistentFlags().StringSlice("target", nil, "operator names to run (default all)")
+	restartCmd.PersistentFlags().StringSlice("exclude", nil, "operator names not to run")
+	addRunFlags(restartCmd)
+	restartCmd.PersistentFlags().String("config", os.Getenv("SCHEDULE_CONFIG"), "schedule config file (default $SCHEDULE_CONFIG)")
 
 	rootCmd.AddCommand(restartCmd)
 }
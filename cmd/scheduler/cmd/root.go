@@ -19,6 +19,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/future-architect/gcp-instance-scheduler/operator"
+	"github.com/future-architect/gcp-instance-scheduler/schedule"
+	"github.com/future-architect/gcp-instance-scheduler/scheduler"
 	"github.com/spf13/cobra"
 )
 
@@ -55,3 +58,82 @@ func getFlags(c *cobra.Command) (project, slackToken, slackChannel string, timeo
 	}
 	return
 }
+
+func getOperatorFlags(c *cobra.Command) (targets, excludes []string, err error) {
+	if targets, err = c.PersistentFlags().GetStringSlice("target"); err != nil {
+		return
+	}
+	if excludes, err = c.PersistentFlags().GetStringSlice("exclude"); err != nil {
+		return
+	}
+	return
+}
+
+// addProjectFlags adds the flags which add the projects under folders or organizations
+func addProjectFlags(c *cobra.Command) {
+	c.PersistentFlags().StringSlice("folder", nil, "folder ids. the active projects under the folders are added")
+	c.PersistentFlags().StringSlice("organization", nil, "organization ids. all active projects in the organizations are added")
+}
+
+func getProjectFlags(c *cobra.Command) (folders, organizations []string, err error) {
+	if folders, err = c.PersistentFlags().GetStringSlice("folder"); err != nil {
+		return
+	}
+	if organizations, err = c.PersistentFlags().GetStringSlice("organization"); err != nil {
+		return
+	}
+	return
+}
+
+// addRunFlags adds the flags which control how the operators run
+func addRunFlags(c *cobra.Command) {
+	c.PersistentFlags().Bool("dry-run", false, "only show the target resources without changing them")
+	c.PersistentFlags().Bool("suspend", false, "suspend the GCE instances instead of stopping them unless the "+scheduler.Label+operator.ModeLabelSuffix+" label is set")
+	c.PersistentFlags().Int64("spanner-processing-units", operator.DefaultSpannerProcessingUnits, "processing units of the Spanner instances at shutdown")
+	c.PersistentFlags().Bool("wait", false, "wait for the operations and report the final status")
+	c.PersistentFlags().Int("concurrency", operator.DefaultConcurrency, "number of the concurrent API calls in an operator")
+	c.PersistentFlags().Float64("rate-limit", operator.DefaultRateLimit, "API calls per second")
+	c.PersistentFlags().Bool("parallel", false, "run independent operators in parallel")
+	c.PersistentFlags().String("state", os.Getenv("STATE_STORE"), "state store of the sizes at shutdown. gs://{bucket}/{object}, firestore://{project}/{collection} or file path (default $STATE_STORE or "+operator.DefaultStateStore+")")
+	c.PersistentFlags().StringToInt("retry", nil, "max retries per error class (rateLimit, unavailable, notReady, conflict). e.g. rateLimit=10,conflict=0")
+}
+
+func getRunFlags(c *cobra.Command, opts *scheduler.Options) (err error) {
+	if opts.DryRun, err = c.PersistentFlags().GetBool("dry-run"); err != nil {
+		return
+	}
+	if opts.Suspend, err = c.PersistentFlags().GetBool("suspend"); err != nil {
+		return
+	}
+	if opts.SpannerProcessingUnits, err = c.PersistentFlags().GetInt64("spanner-processing-units"); err != nil {
+		return
+	}
+	if opts.Wait, err = c.PersistentFlags().GetBool("wait"); err != nil {
+		return
+	}
+	if opts.Concurrency, err = c.PersistentFlags().GetInt("concurrency"); err != nil {
+		return
+	}
+	if opts.RateLimit, err = c.PersistentFlags().GetFloat64("rate-limit"); err != nil {
+		return
+	}
+	if opts.Parallel, err = c.PersistentFlags().GetBool("parallel"); err != nil {
+		return
+	}
+	if opts.Retry, err = c.PersistentFlags().GetStringToInt("retry"); err != nil {
+		return
+	}
+	if opts.StateStore, err = c.PersistentFlags().GetString("state"); err != nil {
+		return
+	}
+	return
+}
+
+// getScheduleConfig loads the schedule config file if designated
+func getScheduleConfig(c *cobra.Command) (*schedule.Config, error) {
+	path, err := c.PersistentFlags().GetString("config")
+	if err != nil || path == "" {
+		return nil, err
+	}
+	return schedule.Load(path)
+}
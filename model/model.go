@@ -17,6 +17,7 @@ package model
 
 import (
 	"fmt"
+	"sort"
 )
 
 const (
@@ -24,22 +25,51 @@ const (
 	InstanceGroup = "InstanceGroup"
 	GKENodePool   = "GKENodePool"
 	SQL           = "SQL"
+	Notebook      = "Notebook"
+	Spanner       = "Spanner"
+	Bigtable      = "Bigtable"
+	Dataproc      = "Dataproc"
+	CloudRun      = "CloudRun"
 )
 
 type Report struct {
-	// InstanceGroup, ComputeEngine, SQL
+	// InstanceGroup, ComputeEngine, SQL, Notebook, Spanner, Bigtable, Dataproc, CloudRun
 	InstanceType string
+	// project ID of the resources
+	Project string
+	// target label value. "true" or schedule name
+	Schedule string
+	// true if no resource was changed. Dones are the resources which would be changed
+	DryRun bool
+	// true if the run was interrupted by the deadline. the rest resources were not processed
+	Partial bool
 	// shutdown resource names
 	Dones []string
 	// already stopped resource names
 	Alreadies []string
-	// skipped resource name
+	// skipped resource names with the reason
 	Skips []string
+	// failed resource names with the error
+	Fails []string
+	// resource names changed by others during the run, with the error
+	Conflicts []string
+	// key=resource name, value=number of the retried API calls
+	Retries map[string]int
 }
 
 func (r *Report) Show() []string {
 	var lines []string
-	lines = append(lines, "."+r.InstanceType)
+	title := "." + r.InstanceType
+	if r.Schedule != "" && r.Schedule != "true" {
+		title += " [" + r.Schedule + "]"
+	}
+	if r.DryRun {
+		title += " (dry-run)"
+	}
+	if r.Partial {
+		title += " (partial)"
+	}
+	lines = append(lines, title)
 
 	lines = append(lines, fmt.Sprintf("  └- Done: %v", len(r.Dones)))
 	for _, resource := range r.Dones {
@@ -56,5 +86,30 @@ func (r *Report) Show() []string {
 		lines = append(lines, fmt.Sprintf("    └-- %v", resource))
 	}
 
+	lines = append(lines, fmt.Sprintf("  └- Fail: %v", len(r.Fails)))
+	for _, resource := range r.Fails {
+		lines = append(lines, fmt.Sprintf("    └-- %v", resource))
+	}
+
+	if len(r.Conflicts) > 0 {
+		lines = append(lines, fmt.Sprintf("  └- Conflict: %v", len(r.Conflicts)))
+		for _, resource := range r.Conflicts {
+			lines = append(lines, fmt.Sprintf("    └-- %v", resource))
+		}
+	}
+
+	if len(r.Retries) > 0 {
+		var names []string
+		for name := range r.Retries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		lines = append(lines, fmt.Sprintf("  └- Retry: %v", len(r.Retries)))
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("    └-- %v (%v times)", name, r.Retries[name]))
+		}
+	}
+
 	return lines
 }
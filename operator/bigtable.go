@@ -0,0 +1,294 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/future-architect/gcp-instance-scheduler/model"
+	"golang.org/x/net/context"
+	bigtableadmin "google.golang.org/api/bigtableadmin/v2"
+)
+
+// BigtableMinNodes is the node count of the Bigtable clusters at shutdown. a cluster can't have no nodes
+const BigtableMinNodes = 1
+
+// BigtableCall scales down the clusters of the Bigtable instances at shutdown, because they can't be stopped
+type BigtableCall struct {
+	s           *bigtableadmin.Service
+	targetLabel string
+	value       string
+	projectID   string
+	conf        Config
+	error       error
+	ctx         context.Context
+}
+
+func Bigtable(ctx context.Context, projectID string, conf Config) *BigtableCall {
+	s, err := bigtableadmin.NewService(ctx)
+	if err != nil {
+		return &BigtableCall{error: err}
+	}
+
+	return &BigtableCall{
+		s:         s,
+		projectID: projectID,
+		conf:      conf,
+		ctx:       ctx,
+	}
+}
+
+func (r *BigtableCall) Name() string {
+	return model.Bigtable
+}
+
+// Filter narrows down the instances after listing, because the list API has no filter
+func (r *BigtableCall) Filter(labelName, value string) Operator {
+	if r.error != nil {
+		return r
+	}
+	r.targetLabel = labelName
+	r.value = value
+	return r
+}
+
+// Stop saves the node count and the autoscaling config of the clusters,
+// disables the autoscaling and scales them down to BigtableMinNodes
+func (r *BigtableCall) Stop() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	instances, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+	for _, instance := range instances {
+		clusters, ok := r.clusters(w, instance)
+		if !ok {
+			continue
+		}
+
+		for _, cluster := range clusters {
+			res := resource{ID: cluster.Name, Name: bigtableName(cluster.Name)}
+			if cluster.State != "READY" {
+				w.skip(res, "state is "+cluster.State)
+				continue
+			}
+
+			// the size was saved by the last shutdown if it is already scaled down
+			autoscaling := bigtableAutoscaling(cluster)
+			if autoscaling == nil && cluster.ServeNodes <= BigtableMinNodes {
+				w.already(res)
+				continue
+			}
+
+			if r.conf.DryRun {
+				w.done(res)
+				continue
+			}
+
+			path := cluster.Name
+			saving := &Size{TargetSize: cluster.ServeNodes, Autoscaler: autoscaling}
+			w.call(res, func() (func() error, error) {
+				if err := r.conf.putState(r.ctx, bigtableKey(path), saving); err != nil {
+					return nil, errors.New("saving size failed: " + err.Error())
+				}
+				// the autoscaling config is removed with the mask and the empty config
+				update := &bigtableadmin.Cluster{ServeNodes: BigtableMinNodes}
+				return r.update(path, update, "serve_nodes,cluster_config.cluster_autoscaling_config")
+			})
+		}
+	}
+
+	return w.report(model.Bigtable)
+}
+
+// Start restores the node count or the autoscaling config saved at shutdown
+func (r *BigtableCall) Start() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	instances, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+	for _, instance := range instances {
+		clusters, ok := r.clusters(w, instance)
+		if !ok {
+			continue
+		}
+
+		for _, cluster := range clusters {
+			res := resource{ID: cluster.Name, Name: bigtableName(cluster.Name)}
+			if cluster.State != "READY" {
+				w.skip(res, "state is "+cluster.State)
+				continue
+			}
+
+			autoscaling := bigtableAutoscaling(cluster)
+			saved, err := r.conf.getState(r.ctx, bigtableKey(cluster.Name))
+			if err != nil {
+				w.fail(res, err)
+				continue
+			}
+			if saved == nil {
+				if autoscaling == nil && cluster.ServeNodes <= BigtableMinNodes {
+					w.skip(res, "size at shutdown is unknown")
+				} else {
+					w.already(res)
+				}
+				continue
+			}
+			w.forget(res, bigtableKey(cluster.Name))
+
+			var update *bigtableadmin.Cluster
+			var mask string
+			if a := saved.Autoscaler; a != nil {
+				if autoscaling != nil && *autoscaling == *a {
+					w.already(res)
+					continue
+				}
+				update = &bigtableadmin.Cluster{ClusterConfig: &bigtableadmin.ClusterConfig{
+					ClusterAutoscalingConfig: &bigtableadmin.ClusterAutoscalingConfig{
+						AutoscalingLimits: &bigtableadmin.AutoscalingLimits{
+							MinServeNodes: a.MinReplicas,
+							MaxServeNodes: a.MaxReplicas,
+						},
+						AutoscalingTargets: &bigtableadmin.AutoscalingTargets{
+							CpuUtilizationPercent:        a.CPUUtilization,
+							StorageUtilizationGibPerNode: a.StorageUtilization,
+						},
+					},
+				}}
+				mask = "cluster_config.cluster_autoscaling_config"
+			} else {
+				if autoscaling == nil && cluster.ServeNodes >= saved.TargetSize {
+					w.already(res)
+					continue
+				}
+				update = &bigtableadmin.Cluster{ServeNodes: saved.TargetSize}
+				mask = "serve_nodes,cluster_config.cluster_autoscaling_config"
+			}
+
+			if r.conf.DryRun {
+				w.done(res)
+				continue
+			}
+
+			path := cluster.Name
+			w.call(res, func() (func() error, error) {
+				return r.update(path, update, mask)
+			})
+		}
+	}
+
+	return w.report(model.Bigtable)
+}
+
+// clusters returns the clusters of the instance, or false if the instance is skipped
+func (r *BigtableCall) clusters(w *worker, instance *bigtableadmin.Instance) ([]*bigtableadmin.Cluster, bool) {
+	target := resource{ID: instance.Name, Name: bigtableName(instance.Name)}
+	if reason, ok := r.conf.skipReason(instance.Labels, r.targetLabel); ok {
+		w.skip(target, reason)
+		return nil, false
+	}
+	// the nodes of the legacy development instances can't be changed
+	if instance.Type == "DEVELOPMENT" {
+		w.skip(target, "development instance can't be scaled")
+		return nil, false
+	}
+
+	var res []*bigtableadmin.Cluster
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = nil
+		return bigtableadmin.NewProjectsInstancesClustersService(r.s).List(instance.Name).Pages(r.ctx, func(list *bigtableadmin.ListClustersResponse) error {
+			res = append(res, list.Clusters...)
+			return nil
+		})
+	})
+	if err != nil {
+		w.fail(target, err)
+		return nil, false
+	}
+	return res, true
+}
+
+// update changes the fields of the cluster in the mask
+func (r *BigtableCall) update(path string, cluster *bigtableadmin.Cluster, mask string) (func() error, error) {
+	op, err := bigtableadmin.NewProjectsInstancesClustersService(r.s).PartialUpdateCluster(path, cluster).UpdateMask(mask).Context(r.ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return waitBigtable(r.ctx, r.conf, r.s, op), nil
+}
+
+// list the labeled instances of all pages
+func (r *BigtableCall) list() ([]*bigtableadmin.Instance, error) {
+	var res []*bigtableadmin.Instance
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = nil
+		return bigtableadmin.NewProjectsInstancesService(r.s).List("projects/"+r.projectID).Pages(r.ctx, func(list *bigtableadmin.ListInstancesResponse) error {
+			for _, instance := range list.Instances {
+				if r.targetLabel != "" && instance.Labels[r.targetLabel] != r.value {
+					continue
+				}
+				res = append(res, instance)
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+// bigtableAutoscaling returns the autoscaling config of the cluster, or nil if the node count is manual
+func bigtableAutoscaling(cluster *bigtableadmin.Cluster) *AutoscalerSize {
+	if cluster.ClusterConfig == nil || cluster.ClusterConfig.ClusterAutoscalingConfig == nil {
+		return nil
+	}
+	c := cluster.ClusterConfig.ClusterAutoscalingConfig
+	res := &AutoscalerSize{Name: bigtableName(cluster.Name)}
+	if c.AutoscalingLimits != nil {
+		res.MinReplicas = c.AutoscalingLimits.MinServeNodes
+		res.MaxReplicas = c.AutoscalingLimits.MaxServeNodes
+	}
+	if c.AutoscalingTargets != nil {
+		res.CPUUtilization = c.AutoscalingTargets.CpuUtilizationPercent
+		res.StorageUtilization = c.AutoscalingTargets.StorageUtilizationGibPerNode
+	}
+	return res
+}
+
+// bigtableKey returns the key of the Bigtable cluster in the state store
+func bigtableKey(path string) string {
+	return "bigtableadmin.googleapis.com/" + path
+}
+
+// name in the report. "instance" or "instance/cluster"
+func bigtableName(path string) string {
+	// projects/{project}/instances/{instance}/clusters/{cluster}
+	elements := strings.Split(path, "/")
+	if len(elements) == 6 {
+		return elements[3] + "/" + elements[5]
+	}
+	return elements[len(elements)-1]
+}
@@ -0,0 +1,535 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/future-architect/gcp-instance-scheduler/model"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	run "google.golang.org/api/run/v1"
+)
+
+// annotation of the revision template which keeps the idle instances
+const minScaleAnnotation = "autoscaling.knative.dev/minScale"
+
+// label of the service region set by Cloud Run
+const locationLabel = "cloud.googleapis.com/location"
+
+// suffix of the copy of a pinned revision with no min instances
+const copySuffix = "-idle"
+
+// max length of a revision name
+const maxRevisionName = 63
+
+// prefixes of the labels and annotations which Cloud Run sets to a revision
+var systemPrefixes = []string{"serving.knative.dev/", "cloud.googleapis.com/", "run.googleapis.com/operation-id"}
+
+// CloudRunCall sets the min instances of the Cloud Run services to 0 at shutdown.
+// the services are listed by the global endpoint, and changed by the regional endpoints
+type CloudRunCall struct {
+	s           *run.APIService
+	regions     map[string]*run.APIService
+	targetLabel string
+	selector    string
+	projectID   string
+	conf        Config
+	error       error
+	ctx         context.Context
+}
+
+func CloudRun(ctx context.Context, projectID string, conf Config) *CloudRunCall {
+	s, err := run.NewService(ctx)
+	if err != nil {
+		return &CloudRunCall{error: err}
+	}
+
+	return &CloudRunCall{
+		s:         s,
+		regions:   make(map[string]*run.APIService),
+		projectID: projectID,
+		conf:      conf,
+		ctx:       ctx,
+	}
+}
+
+func (r *CloudRunCall) Name() string {
+	return model.CloudRun
+}
+
+func (r *CloudRunCall) Filter(labelName, value string) Operator {
+	if r.error != nil {
+		return r
+	}
+	r.targetLabel = labelName
+	r.selector = labelName + "=" + value
+	return r
+}
+
+// Stop saves the min instances of the target services and sets them to 0.
+// the revisions pinned in the traffic split keep their own min instances, so their traffic is moved to the copies
+// of them with no min instances
+func (r *CloudRunCall) Stop() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	services, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+	for _, service := range services {
+		name := service.Metadata.Name
+		region := service.Metadata.Labels[locationLabel]
+		res := resource{ID: region + "/" + name, Name: name}
+		current, ok := r.check(w, res, service)
+		if !ok {
+			continue
+		}
+		copies, err := r.copies(region, service)
+		if err != nil {
+			w.fail(res, err)
+			continue
+		}
+		if current == 0 && len(copies) == 0 {
+			w.already(res)
+			continue
+		}
+
+		if r.conf.DryRun {
+			w.done(res)
+			continue
+		}
+
+		service := service
+		saving := &Size{MinInstances: current, Revisions: copies}
+		w.run(func() {
+			err := w.exec(res, func() error {
+				return r.conf.putState(r.ctx, runKey(r.projectID, region, name), saving)
+			})
+			if err != nil {
+				w.fail(res, errors.New("saving size failed: "+err.Error()))
+				return
+			}
+			if err := r.idle(w, res, region, service, copies); err != nil {
+				w.abort(res, err)
+				return
+			}
+			w.done(res)
+		})
+	}
+
+	return w.report(model.CloudRun)
+}
+
+// Start restores the min instances saved at shutdown, and moves the traffic back to the pinned revisions
+func (r *CloudRunCall) Start() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	services, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+	for _, service := range services {
+		name := service.Metadata.Name
+		region := service.Metadata.Labels[locationLabel]
+		res := resource{ID: region + "/" + name, Name: name}
+		current, ok := r.check(w, res, service)
+		if !ok {
+			continue
+		}
+
+		// a service without saved min instances scales from 0 as usual
+		saved, err := r.conf.getState(r.ctx, runKey(r.projectID, region, name))
+		if err != nil {
+			w.fail(res, err)
+			continue
+		}
+		if saved == nil {
+			w.already(res)
+			continue
+		}
+		w.forget(res, runKey(r.projectID, region, name))
+		resizing := current < saved.MinInstances
+		originals := make(map[string]string)
+		for revision, copied := range saved.Revisions {
+			originals[copied] = revision
+		}
+		if !resizing && !routed(service.Spec.Traffic, originals) {
+			w.already(res)
+			continue
+		}
+
+		if r.conf.DryRun {
+			w.done(res)
+			continue
+		}
+
+		service := service
+		w.run(func() {
+			if resizing {
+				setMinScale(service.Spec.Template, saved.MinInstances)
+			}
+			service.Spec.Traffic = route(service.Spec.Traffic, originals)
+			wait, err := r.replace(w, res, region, service)
+			if err == nil && r.conf.Wait {
+				err = wait()
+			}
+			if err != nil {
+				w.abort(res, err)
+				return
+			}
+			w.done(res)
+		})
+	}
+
+	return w.report(model.CloudRun)
+}
+
+// check returns the min instances of the latest revision template, or false if the service is skipped
+func (r *CloudRunCall) check(w *worker, res resource, service *run.Service) (int64, bool) {
+	if reason, ok := r.conf.skipReason(service.Metadata.Labels, r.targetLabel); ok {
+		w.skip(res, reason)
+		return 0, false
+	}
+	if service.Spec == nil || service.Spec.Template == nil {
+		w.skip(res, "no revision template")
+		return 0, false
+	}
+
+	n, err := minScale(service.Spec.Template.Metadata)
+	if err != nil {
+		w.fail(res, err)
+		return 0, false
+	}
+	return n, true
+}
+
+// copies returns map that key=revision pinned in the traffic with min instances and value=name of the copy
+func (r *CloudRunCall) copies(region string, service *run.Service) (map[string]string, error) {
+	s, ok := r.regions[region]
+	if !ok {
+		return nil, errors.New("unknown region: " + region)
+	}
+
+	res := make(map[string]string)
+	for _, t := range service.Spec.Traffic {
+		if t.Percent == 0 || t.LatestRevision || t.RevisionName == "" {
+			continue
+		}
+		var revision *run.Revision
+		_, err := r.conf.retry(r.ctx, func() error {
+			var err error
+			revision, err = r.revision(s, t.RevisionName)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if revision == nil {
+			return nil, errors.New("revision not found: " + t.RevisionName)
+		}
+		n, err := minScale(revision.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		copied := t.RevisionName + copySuffix
+		if len(copied) > maxRevisionName {
+			return nil, errors.New("revision name is too long to copy: " + t.RevisionName)
+		}
+		res[t.RevisionName] = copied
+	}
+	return res, nil
+}
+
+// idle deploys the copies of the pinned revisions one by one, and then deploys the latest revision template
+// with no min instances and moves the traffic of the pinned revisions to the copies.
+// each copy becomes the latest revision, so the traffic of the latest revision is pinned to the latest ready revision
+// at the beginning until the last change
+func (r *CloudRunCall) idle(w *worker, res resource, region string, service *run.Service, copies map[string]string) error {
+	s, ok := r.regions[region]
+	if !ok {
+		return errors.New("unknown region: " + region)
+	}
+	template, traffic := service.Spec.Template, service.Spec.Traffic
+	latest := ""
+	if service.Status != nil {
+		latest = service.Status.LatestReadyRevisionName
+	}
+
+	var revisions []string
+	for revision := range copies {
+		revisions = append(revisions, revision)
+	}
+	sort.Strings(revisions)
+	for _, revision := range revisions {
+		// the copy deployed by the interrupted shutdown is used as it is
+		var copied, original *run.Revision
+		err := w.exec(res, func() error {
+			var err error
+			if copied, err = r.revision(s, copies[revision]); err != nil || copied != nil {
+				return err
+			}
+			original, err = r.revision(s, revision)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if copied != nil {
+			continue
+		}
+		if original == nil {
+			return errors.New("revision not found: " + revision)
+		}
+		if latest == "" {
+			return errors.New("no ready revision")
+		}
+
+		service.Spec.Template = copyTemplate(original, copies[revision])
+		service.Spec.Traffic = pin(traffic, latest)
+		wait, err := r.replace(w, res, region, service)
+		if err != nil {
+			return err
+		}
+		if err := wait(); err != nil {
+			return err
+		}
+		// the next change is based on the replaced service
+		if err := w.exec(res, func() error {
+			var err error
+			service, err = run.NewNamespacesServicesService(s).Get(servicePath(r.projectID, service.Metadata.Name)).Context(r.ctx).Do()
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	setMinScale(template, 0)
+	service.Spec.Template = template
+	service.Spec.Traffic = route(traffic, copies)
+	wait, err := r.replace(w, res, region, service)
+	if err != nil {
+		return err
+	}
+	if r.conf.Wait {
+		return wait()
+	}
+	return nil
+}
+
+// replace replaces the service by the regional endpoint, and returns the function which waits until it is ready.
+// the resource version of the service rejects the change by others after it was got
+func (r *CloudRunCall) replace(w *worker, res resource, region string, service *run.Service) (func() error, error) {
+	s, ok := r.regions[region]
+	if !ok {
+		return nil, errors.New("unknown region: " + region)
+	}
+	path := servicePath(r.projectID, service.Metadata.Name)
+	service.Status = nil
+
+	var replaced *run.Service
+	err := w.exec(res, func() error {
+		var err error
+		replaced, err = run.NewNamespacesServicesService(s).ReplaceService(path, service).Context(r.ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return waitRun(r.ctx, r.conf, s, path, replaced.Metadata.Generation), nil
+}
+
+// revision returns the revision of the name, or nil if not found
+func (r *CloudRunCall) revision(s *run.APIService, name string) (*run.Revision, error) {
+	revision, err := run.NewNamespacesRevisionsService(s).Get("namespaces/" + r.projectID + "/revisions/" + name).Context(r.ctx).Do()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	return revision, err
+}
+
+// setMinScale sets the min instances to the revision template. the revision name is cleared to be generated,
+// because the named revision already exists
+func setMinScale(template *run.RevisionTemplate, n int64) {
+	if template.Metadata == nil {
+		template.Metadata = &run.ObjectMeta{}
+	}
+	template.Metadata.Name = ""
+	if template.Metadata.Annotations == nil {
+		template.Metadata.Annotations = make(map[string]string)
+	}
+	if n == 0 {
+		delete(template.Metadata.Annotations, minScaleAnnotation)
+	} else {
+		template.Metadata.Annotations[minScaleAnnotation] = strconv.FormatInt(n, 10)
+	}
+}
+
+// copyTemplate returns the revision template which creates the copy of the revision with no min instances.
+// the labels and annotations set by Cloud Run are not copied
+func copyTemplate(revision *run.Revision, name string) *run.RevisionTemplate {
+	meta := &run.ObjectMeta{
+		Name:        name,
+		Labels:      make(map[string]string),
+		Annotations: make(map[string]string),
+	}
+	if revision.Metadata != nil {
+		for k, v := range revision.Metadata.Labels {
+			if !system(k) {
+				meta.Labels[k] = v
+			}
+		}
+		for k, v := range revision.Metadata.Annotations {
+			if !system(k) && k != minScaleAnnotation {
+				meta.Annotations[k] = v
+			}
+		}
+	}
+	return &run.RevisionTemplate{Metadata: meta, Spec: revision.Spec}
+}
+
+// system reports whether the label or annotation is set by Cloud Run
+func system(key string) bool {
+	for _, prefix := range systemPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// pin returns the traffic whose targets of the latest revision are pinned to the revision
+func pin(traffic []*run.TrafficTarget, revision string) []*run.TrafficTarget {
+	var res []*run.TrafficTarget
+	for _, t := range traffic {
+		t := *t
+		if t.LatestRevision {
+			t.LatestRevision = false
+			t.RevisionName = revision
+		}
+		res = append(res, &t)
+	}
+	return res
+}
+
+// route returns the traffic whose targets are moved to the revisions. key=current revision, value=new revision
+func route(traffic []*run.TrafficTarget, revisions map[string]string) []*run.TrafficTarget {
+	var res []*run.TrafficTarget
+	for _, t := range traffic {
+		t := *t
+		if revision, ok := revisions[t.RevisionName]; ok && !t.LatestRevision {
+			t.RevisionName = revision
+		}
+		res = append(res, &t)
+	}
+	return res
+}
+
+// routed reports whether any target of the traffic is the revisions to move
+func routed(traffic []*run.TrafficTarget, revisions map[string]string) bool {
+	for _, t := range traffic {
+		if _, ok := revisions[t.RevisionName]; ok && !t.LatestRevision {
+			return true
+		}
+	}
+	return false
+}
+
+// servicePath returns the path of the Cloud Run service by the regional endpoint
+func servicePath(projectID, name string) string {
+	return "namespaces/" + projectID + "/services/" + name
+}
+
+// list the target services of all regions, and prepares the regional endpoints
+func (r *CloudRunCall) list() ([]*run.Service, error) {
+	var res []*run.Service
+	parent := "namespaces/" + r.projectID
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = nil
+		token := ""
+		for {
+			call := run.NewNamespacesServicesService(r.s).List(parent).Context(r.ctx)
+			if r.selector != "" {
+				call = call.LabelSelector(r.selector)
+			}
+			if token != "" {
+				call = call.Continue(token)
+			}
+			list, err := call.Do()
+			if err != nil {
+				return err
+			}
+			res = append(res, list.Items...)
+			if list.Metadata == nil || list.Metadata.Continue == "" {
+				return nil
+			}
+			token = list.Metadata.Continue
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, service := range res {
+		region := service.Metadata.Labels[locationLabel]
+		if _, ok := r.regions[region]; ok || region == "" {
+			continue
+		}
+		s, err := run.NewService(r.ctx, option.WithEndpoint("https://"+region+"-run.googleapis.com/"))
+		if err != nil {
+			return nil, err
+		}
+		r.regions[region] = s
+	}
+	return res, nil
+}
+
+// minScale returns the min instances in the metadata of the revision or the revision template. 0 if not set
+func minScale(meta *run.ObjectMeta) (int64, error) {
+	if meta == nil {
+		return 0, nil
+	}
+	v, ok := meta.Annotations[minScaleAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid " + minScaleAnnotation + " annotation: " + v)
+	}
+	return n, nil
+}
+
+// runKey returns the key of the Cloud Run service in the state store
+func runKey(projectID, region, name string) string {
+	return "run.googleapis.com/projects/" + projectID + "/locations/" + region + "/services/" + name
+}
@@ -0,0 +1,103 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"reflect"
+	"testing"
+
+	run "google.golang.org/api/run/v1"
+)
+
+func TestPinAndRoute(t *testing.T) {
+	traffic := []*run.TrafficTarget{
+		{LatestRevision: true, Percent: 50},
+		{RevisionName: "web-00002-abc", Percent: 30, Tag: "blue"},
+		{RevisionName: "web-00001-xyz", Percent: 20},
+	}
+
+	pinned := pin(traffic, "web-00003-def")
+	want := []*run.TrafficTarget{
+		{RevisionName: "web-00003-def", Percent: 50},
+		{RevisionName: "web-00002-abc", Percent: 30, Tag: "blue"},
+		{RevisionName: "web-00001-xyz", Percent: 20},
+	}
+	if !reflect.DeepEqual(pinned, want) {
+		t.Errorf("pin() = %v, want %v", pinned, want)
+	}
+
+	copies := map[string]string{"web-00002-abc": "web-00002-abc-idle"}
+	moved := route(traffic, copies)
+	want = []*run.TrafficTarget{
+		{LatestRevision: true, Percent: 50},
+		{RevisionName: "web-00002-abc-idle", Percent: 30, Tag: "blue"},
+		{RevisionName: "web-00001-xyz", Percent: 20},
+	}
+	if !reflect.DeepEqual(moved, want) {
+		t.Errorf("route() = %v, want %v", moved, want)
+	}
+	if traffic[1].RevisionName != "web-00002-abc" || !traffic[0].LatestRevision {
+		t.Error("pin() or route() changes the original traffic")
+	}
+
+	originals := map[string]string{"web-00002-abc-idle": "web-00002-abc"}
+	if !routed(moved, originals) {
+		t.Error("routed() = false, want true for the copy")
+	}
+	if routed(traffic, originals) {
+		t.Error("routed() = true, want false for the original traffic")
+	}
+	if got := route(moved, originals); !reflect.DeepEqual(got, traffic) {
+		t.Errorf("route() back = %v, want %v", got, traffic)
+	}
+}
+
+func TestCopyTemplate(t *testing.T) {
+	revision := &run.Revision{
+		Metadata: &run.ObjectMeta{
+			Name: "web-00002-abc",
+			Labels: map[string]string{
+				"team":                          "dev",
+				"serving.knative.dev/service":   "web",
+				"cloud.googleapis.com/location": "asia-northeast1",
+			},
+			Annotations: map[string]string{
+				minScaleAnnotation:                  "2",
+				"autoscaling.knative.dev/maxScale":  "10",
+				"serving.knative.dev/creator":       "dev@example.com",
+				"run.googleapis.com/operation-id":   "123",
+				"run.googleapis.com/cpu-throttling": "false",
+			},
+		},
+		Spec: &run.RevisionSpec{ContainerConcurrency: 80},
+	}
+
+	got := copyTemplate(revision, "web-00002-abc-idle")
+	want := &run.RevisionTemplate{
+		Metadata: &run.ObjectMeta{
+			Name:   "web-00002-abc-idle",
+			Labels: map[string]string{"team": "dev"},
+			Annotations: map[string]string{
+				"autoscaling.knative.dev/maxScale":  "10",
+				"run.googleapis.com/cpu-throttling": "false",
+			},
+		},
+		Spec: revision.Spec,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("copyTemplate() = %v, want %v", got, want)
+	}
+}
@@ -1,6 +1,38 @@
 package operator
 
-import "time"
+import (
+	"time"
 
-// API call interval
-const CallInterval = 50 * time.Millisecond
+	"golang.org/x/time/rate"
+)
+
+// default number of the concurrent API calls in an operator
+const DefaultConcurrency = 10
+
+// default API call rate limit (calls per second) in a run
+const DefaultRateLimit = 20
+
+// polling interval of long-running operations
+const OperationPollInterval = 2 * time.Second
+
+// Config is the common settings of operators in a run
+type Config struct {
+	// DryRun lists and filters the target resources, but never changes them
+	DryRun bool
+	// Suspend suspends the GCE instances instead of stopping them. the mode label of an instance takes precedence
+	Suspend bool
+	// SpannerProcessingUnits is the processing units of the Spanner instances at shutdown (default DefaultSpannerProcessingUnits)
+	SpannerProcessingUnits int64
+	// Wait polls the long-running operations until done and reports the final status
+	Wait bool
+	// time zone of the protection label values (default UTC)
+	Location *time.Location
+	// Concurrency is the number of the concurrent API calls in an operator (default DefaultConcurrency)
+	Concurrency int
+	// Limiter limits the API call rate. it should be shared by the operators in a run (default no limit)
+	Limiter *rate.Limiter
+	// Retry is the retry policies of the API calls (default no retry)
+	Retry Retry
+	// State saves the sizes of the managed instance groups at shutdown
+	State StateStore
+}
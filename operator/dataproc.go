@@ -0,0 +1,244 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/future-architect/gcp-instance-scheduler/model"
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+	dataproc "google.golang.org/api/dataproc/v1"
+)
+
+// DataprocClusterLabel is the label which Dataproc sets to the VMs of the cluster.
+// the VMs are stopped and started with the cluster, not by ComputeEngineCall
+const DataprocClusterLabel = "goog-dataproc-cluster-name"
+
+// DataprocCall stops and starts the Dataproc clusters in all regions
+type DataprocCall struct {
+	s           *dataproc.Service
+	cs          *compute.Service
+	filter      string
+	targetLabel string
+	projectID   string
+	conf        Config
+	error       error
+	ctx         context.Context
+}
+
+func Dataproc(ctx context.Context, projectID string, conf Config) *DataprocCall {
+	s, err := dataproc.NewService(ctx)
+	if err != nil {
+		return &DataprocCall{error: err}
+	}
+	// the regions are listed by the compute API because Dataproc lists the clusters per region
+	cs, err := compute.NewService(ctx)
+	if err != nil {
+		return &DataprocCall{error: err}
+	}
+
+	return &DataprocCall{
+		s:         s,
+		cs:        cs,
+		projectID: projectID,
+		conf:      conf,
+		ctx:       ctx,
+	}
+}
+
+func (r *DataprocCall) Name() string {
+	return model.Dataproc
+}
+
+func (r *DataprocCall) Filter(labelName, value string) Operator {
+	if r.error != nil {
+		return r
+	}
+	r.targetLabel = labelName
+	r.filter = "labels." + labelName + " = " + value
+	return r
+}
+
+func (r *DataprocCall) Stop() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	clusters, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+	for region, list := range clusters {
+		for _, cluster := range list {
+			name := cluster.ClusterName
+			res := resource{ID: region + "/" + name, Name: name}
+			if reason, ok := r.conf.skipReason(cluster.Labels, r.targetLabel); ok {
+				w.skip(res, reason)
+				continue
+			}
+
+			// check a cluster which was already stopped
+			state := clusterState(cluster)
+			if state == "STOPPED" || state == "STOPPING" {
+				w.already(res)
+				continue
+			}
+			if state != "RUNNING" {
+				w.skip(res, "state is "+state)
+				continue
+			}
+
+			if r.conf.DryRun {
+				w.done(res)
+				continue
+			}
+
+			region := region
+			w.call(res, func() (func() error, error) {
+				op, err := dataproc.NewProjectsRegionsClustersService(r.s).Stop(r.projectID, region, name, &dataproc.StopClusterRequest{}).Context(r.ctx).Do()
+				if err != nil {
+					return nil, errors.New("stopping failed: " + err.Error())
+				}
+				return waitDataproc(r.ctx, r.conf, r.s, op), nil
+			})
+		}
+	}
+
+	return w.report(model.Dataproc)
+}
+
+func (r *DataprocCall) Start() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	clusters, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+	for region, list := range clusters {
+		for _, cluster := range list {
+			name := cluster.ClusterName
+			res := resource{ID: region + "/" + name, Name: name}
+			if reason, ok := r.conf.skipReason(cluster.Labels, r.targetLabel); ok {
+				w.skip(res, reason)
+				continue
+			}
+
+			// check a cluster which was already running
+			state := clusterState(cluster)
+			if state == "RUNNING" || state == "STARTING" || state == "CREATING" {
+				w.already(res)
+				continue
+			}
+			if state != "STOPPED" {
+				w.skip(res, "state is "+state)
+				continue
+			}
+
+			if r.conf.DryRun {
+				w.done(res)
+				continue
+			}
+
+			region := region
+			w.call(res, func() (func() error, error) {
+				op, err := dataproc.NewProjectsRegionsClustersService(r.s).Start(r.projectID, region, name, &dataproc.StartClusterRequest{}).Context(r.ctx).Do()
+				if err != nil {
+					return nil, err
+				}
+				return waitDataproc(r.ctx, r.conf, r.s, op), nil
+			})
+		}
+	}
+
+	return w.report(model.Dataproc)
+}
+
+// list the target clusters of all regions. key=region.
+// the regions are listed concurrently on the workers, because most of them have no cluster
+func (r *DataprocCall) list() (map[string][]*dataproc.Cluster, error) {
+	regions, err := r.regions()
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var errs error
+	res := make(map[string][]*dataproc.Cluster)
+	w := newWorker(r.ctx, r.conf)
+	for _, region := range regions {
+		region := region
+		w.run(func() {
+			var clusters []*dataproc.Cluster
+			err := w.exec(named(region), func() error {
+				clusters = nil
+				call := dataproc.NewProjectsRegionsClustersService(r.s).List(r.projectID, region)
+				if r.filter != "" {
+					call = call.Filter(r.filter)
+				}
+				return call.Pages(r.ctx, func(list *dataproc.ListClustersResponse) error {
+					clusters = append(clusters, list.Clusters...)
+					return nil
+				})
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = multierror.Append(errs, errors.New(region+": "+err.Error()))
+				return
+			}
+			if len(clusters) > 0 {
+				res[region] = clusters
+			}
+		})
+	}
+	w.sync()
+	if errs != nil {
+		return nil, errs
+	}
+	return res, nil
+}
+
+// regions returns the compute regions and "global" of the legacy clusters
+func (r *DataprocCall) regions() ([]string, error) {
+	res := []string{"global"}
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = res[:1]
+		return compute.NewRegionsService(r.cs).List(r.projectID).Pages(r.ctx, func(list *compute.RegionList) error {
+			for _, region := range list.Items {
+				res = append(res, region.Name)
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+func clusterState(cluster *dataproc.Cluster) string {
+	if cluster.Status == nil {
+		return ""
+	}
+	return cluster.Status.State
+}
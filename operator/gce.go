@@ -18,39 +18,61 @@ package operator
 import (
 	"errors"
 	"strings"
-	"time"
 
 	"github.com/future-architect/gcp-instance-scheduler/model"
-	"github.com/hashicorp/go-multierror"
 	"golang.org/x/net/context"
 	"google.golang.org/api/compute/v1"
 )
 
+// ModeLabelSuffix is the suffix of the label name which selects how the instance is stopped.
+// e.g. state-scheduler-mode: suspend
+const ModeLabelSuffix = "-mode"
+
+const (
+	// ModeStop stops the instance. the memory is discarded
+	ModeStop = "stop"
+	// ModeSuspend suspends the instance. the memory is preserved and the instance is resumed at start
+	ModeSuspend = "suspend"
+)
+
+// CreatedByMetadata is the metadata key which the managed instance group sets to its instances.
+// the instances (including GKE nodes) are resized with the group, not by ComputeEngineCall
+const CreatedByMetadata = "created-by"
+
 type ComputeEngineCall struct {
-	s         *compute.Service
-	call      *compute.InstancesAggregatedListCall
-	projectID string
-	error     error
+	s           *compute.Service
+	call        *compute.InstancesAggregatedListCall
+	targetLabel string
+	projectID   string
+	conf        Config
+	error       error
+	ctx         context.Context
 }
 
-func ComputeEngine(ctx context.Context, projectID string) *ComputeEngineCall {
+func ComputeEngine(ctx context.Context, projectID string, conf Config) *ComputeEngineCall {
 	s, err := compute.NewService(ctx)
 	if err != nil {
 		return &ComputeEngineCall{error: err}
 	}
-
 	// get all instances in each zone at this project
 	return &ComputeEngineCall{
 		s:         s,
 		projectID: projectID,
+		conf:      conf,
+		ctx:       ctx,
 		call:      compute.NewInstancesService(s).AggregatedList(projectID),
 	}
 }
 
-func (r *ComputeEngineCall) Filter(labelName, value string) *ComputeEngineCall {
+func (r *ComputeEngineCall) Name() string {
+	return model.ComputeEngine
+}
+
+func (r *ComputeEngineCall) Filter(labelName, value string) Operator {
 	if r.error != nil {
 		return r
 	}
+	r.targetLabel = labelName
 	r.call = r.call.Filter("labels." + labelName + "=" + value)
 	return r
 }
@@ -60,41 +82,82 @@ func (r *ComputeEngineCall) Stop() (*model.Report, error) {
 		return nil, r.error
 	}
 
-	list, err := r.call.Do()
+	instances, err := r.list()
 	if err != nil {
 		return nil, err
 	}
 
-	var res = r.error
-	var doneRes []string
-	var alreadyRes []string
+	w := newWorker(r.ctx, r.conf)
+	for _, instance := range instances {
+		// get zone name
+		urlElements := strings.Split(instance.Zone, "/")
+		zone := urlElements[len(urlElements)-1]
+		res := resource{ID: zone + "/" + instance.Name, Name: instance.Name}
+
+		if reason, ok := r.conf.skipReason(instance.Labels, r.targetLabel); ok {
+			w.skip(res, reason)
+			continue
+		}
+		if cluster, ok := instance.Labels[DataprocClusterLabel]; ok {
+			w.skip(res, "managed by Dataproc cluster "+cluster)
+			continue
+		}
+		if hasMetadata(instance, NotebookMetadata) {
+			w.skip(res, "managed by Vertex AI Workbench")
+			continue
+		}
+		if group := createdBy(instance); group != "" {
+			w.skip(res, "managed by instance group "+group)
+			continue
+		}
 
-	for _, instance := range valuesGCE(list.Items) {
-		// check a instance which was already stopped
+		// check a instance which was already stopped or suspended
+		if instance.Status == "SUSPENDED" || instance.Status == "SUSPENDING" {
+			w.mode(res, "suspended")
+			w.already(res)
+			continue
+		}
 		if instance.Status == "STOPPED" || instance.Status == "STOPPING" || instance.Status == "TERMINATED" ||
 			instance.Status == "PROVISIONING" || instance.Status == "REPAIRING" {
-			alreadyRes = append(alreadyRes, instance.Name)
+			w.already(res)
 			continue
 		}
 
-		// get zone name
-		urlElements := strings.Split(instance.Zone, "/")
-		zone := urlElements[len(urlElements)-1]
-
-		_, err = compute.NewInstancesService(r.s).Stop(r.projectID, zone, instance.Name).Do()
+		mode, err := r.mode(instance.Labels)
 		if err != nil {
-			res = multierror.Append(res, errors.New(instance.Name+" stopping failed: %v"+err.Error()))
+			w.skip(res, err.Error())
+			continue
+		}
+		if mode == ModeSuspend {
+			w.mode(res, "suspended")
+		}
+
+		if r.conf.DryRun {
+			w.done(res)
+			continue
 		}
 
-		doneRes = append(doneRes, instance.Name)
-		time.Sleep(CallInterval)
+		name := instance.Name
+		if mode == ModeSuspend {
+			w.call(res, func() (func() error, error) {
+				op, err := compute.NewInstancesService(r.s).Suspend(r.projectID, zone, name).Context(r.ctx).Do()
+				if err != nil {
+					return nil, errors.New("suspending failed: " + err.Error())
+				}
+				return waitZone(r.ctx, r.conf, r.s, r.projectID, zone, op), nil
+			})
+			continue
+		}
+		w.call(res, func() (func() error, error) {
+			op, err := compute.NewInstancesService(r.s).Stop(r.projectID, zone, name).Context(r.ctx).Do()
+			if err != nil {
+				return nil, errors.New("stopping failed: " + err.Error())
+			}
+			return waitZone(r.ctx, r.conf, r.s, r.projectID, zone, op), nil
+		})
 	}
 
-	return &model.Report{
-		InstanceType: model.ComputeEngine,
-		Dones:        doneRes,
-		Alreadies:    alreadyRes,
-	}, res
+	return w.report(model.ComputeEngine)
 }
 
 func (r *ComputeEngineCall) Start() (*model.Report, error) {
@@ -102,40 +165,137 @@ func (r *ComputeEngineCall) Start() (*model.Report, error) {
 		return nil, r.error
 	}
 
-	list, err := r.call.Do()
+	instances, err := r.list()
 	if err != nil {
 		return nil, err
 	}
 
-	var res = r.error
-	var doneRes []string
-	var alreadyRes []string
+	w := newWorker(r.ctx, r.conf)
+	for _, instance := range instances {
+		// get zone name
+		urlElements := strings.Split(instance.Zone, "/")
+		zone := urlElements[len(urlElements)-1]
+		res := resource{ID: zone + "/" + instance.Name, Name: instance.Name}
+
+		if reason, ok := r.conf.skipReason(instance.Labels, r.targetLabel); ok {
+			w.skip(res, reason)
+			continue
+		}
+		if cluster, ok := instance.Labels[DataprocClusterLabel]; ok {
+			w.skip(res, "managed by Dataproc cluster "+cluster)
+			continue
+		}
+		if hasMetadata(instance, NotebookMetadata) {
+			w.skip(res, "managed by Vertex AI Workbench")
+			continue
+		}
+		if group := createdBy(instance); group != "" {
+			w.skip(res, "managed by instance group "+group)
+			continue
+		}
 
-	for _, instance := range valuesGCE(list.Items) {
 		// check a instance which was already running
-		if instance.Status == "RUNNING" || instance.Status == "PROVISIONING" || instance.Status == "REPAIRING" {
-			alreadyRes = append(alreadyRes, instance.Name)
+		if instance.Status == "RUNNING" || instance.Status == "PROVISIONING" || instance.Status == "STAGING" ||
+			instance.Status == "REPAIRING" {
+			w.already(res)
+			continue
+		}
+		// a suspending instance can't be resumed until it is suspended
+		if instance.Status == "SUSPENDING" {
+			w.skip(res, "suspending")
 			continue
 		}
 
-		// get zone name
-		urlElements := strings.Split(instance.Zone, "/")
-		zone := urlElements[len(urlElements)-1]
+		// a suspended instance is resumed regardless of the mode because it can't be started
+		resuming := instance.Status == "SUSPENDED"
+		if resuming {
+			w.mode(res, "resumed")
+		}
 
-		_, err = compute.NewInstancesService(r.s).Start(r.projectID, zone, instance.Name).Do()
-		if err != nil {
-			res = multierror.Append(res, err)
+		if r.conf.DryRun {
+			w.done(res)
+			continue
+		}
+
+		name := instance.Name
+		if resuming {
+			w.call(res, func() (func() error, error) {
+				op, err := compute.NewInstancesService(r.s).Resume(r.projectID, zone, name).Context(r.ctx).Do()
+				if err != nil {
+					return nil, errors.New("resuming failed: " + err.Error())
+				}
+				return waitZone(r.ctx, r.conf, r.s, r.projectID, zone, op), nil
+			})
+			continue
 		}
+		w.call(res, func() (func() error, error) {
+			op, err := compute.NewInstancesService(r.s).Start(r.projectID, zone, name).Context(r.ctx).Do()
+			if err != nil {
+				return nil, err
+			}
+			return waitZone(r.ctx, r.conf, r.s, r.projectID, zone, op), nil
+		})
+	}
+
+	return w.report(model.ComputeEngine)
+}
+
+// mode returns how the instance is stopped. the mode label takes precedence over Config.Suspend
+func (r *ComputeEngineCall) mode(labels map[string]string) (string, error) {
+	name := r.targetLabel + ModeLabelSuffix
+	v, ok := labels[name]
+	if !ok {
+		if r.conf.Suspend {
+			return ModeSuspend, nil
+		}
+		return ModeStop, nil
+	}
+	if v != ModeStop && v != ModeSuspend {
+		return "", errors.New("invalid " + name + " label: " + v)
+	}
+	return v, nil
+}
+
+// createdBy returns the name of the managed instance group of the instance, or "" if it is not managed.
+// the value of the metadata is the URL of the group. e.g. projects/123/zones/asia-northeast1-a/instanceGroupManagers/web
+func createdBy(instance *compute.Instance) string {
+	if instance.Metadata == nil {
+		return ""
+	}
+	for _, item := range instance.Metadata.Items {
+		if item.Key != CreatedByMetadata || item.Value == nil {
+			continue
+		}
+		elements := strings.Split(*item.Value, "/")
+		return elements[len(elements)-1]
+	}
+	return ""
+}
 
-		doneRes = append(doneRes, instance.Name)
-		time.Sleep(CallInterval)
+// hasMetadata reports whether the instance has the metadata key
+func hasMetadata(instance *compute.Instance, key string) bool {
+	if instance.Metadata == nil {
+		return false
 	}
+	for _, item := range instance.Metadata.Items {
+		if item.Key == key {
+			return true
+		}
+	}
+	return false
+}
 
-	return &model.Report{
-		InstanceType: model.ComputeEngine,
-		Dones:        doneRes,
-		Alreadies:    alreadyRes,
-	}, res
+// list the target instances of all pages
+func (r *ComputeEngineCall) list() ([]*compute.Instance, error) {
+	var res []*compute.Instance
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = nil
+		return r.call.Pages(r.ctx, func(list *compute.InstanceAggregatedList) error {
+			res = append(res, valuesGCE(list.Items)...)
+			return nil
+		})
+	})
+	return res, err
 }
 
 // create instance list
@@ -0,0 +1,75 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestCreatedBy(t *testing.T) {
+	value := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		instance *compute.Instance
+		want     string
+	}{
+		{"no metadata", &compute.Instance{}, ""},
+		{"other metadata", &compute.Instance{Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+			{Key: "startup-script", Value: value("echo")},
+		}}}, ""},
+		{"instance group", &compute.Instance{Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+			{Key: "startup-script", Value: value("echo")},
+			{Key: CreatedByMetadata, Value: value("projects/123/zones/asia-northeast1-a/instanceGroupManagers/web")},
+		}}}, "web"},
+		{"gke node", &compute.Instance{Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+			{Key: CreatedByMetadata, Value: value("projects/123/zones/asia-northeast1-a/instanceGroupManagers/gke-dev-default-pool-1a2b3c4d-grp")},
+		}}}, "gke-dev-default-pool-1a2b3c4d-grp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := createdBy(tt.instance); got != tt.want {
+				t.Errorf("createdBy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasMetadata(t *testing.T) {
+	value := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		instance *compute.Instance
+		want     bool
+	}{
+		{"no metadata", &compute.Instance{}, false},
+		{"other metadata", &compute.Instance{Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+			{Key: "startup-script", Value: value("echo")},
+		}}}, false},
+		{"notebook", &compute.Instance{Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+			{Key: "proxy-mode", Value: value("service_account")},
+			{Key: NotebookMetadata, Value: value("PROD")},
+		}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasMetadata(tt.instance, NotebookMetadata); got != tt.want {
+				t.Errorf("hasMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
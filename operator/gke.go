@@ -16,44 +16,50 @@
 package operator
 
 import (
-	"errors"
-	"fmt"
-	set "github.com/deckarep/golang-set"
 	"github.com/future-architect/gcp-instance-scheduler/model"
-	"github.com/hashicorp/go-multierror"
 	"golang.org/x/net/context"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/container/v1"
 	"strconv"
 	"strings"
-	"time"
-	"regexp"
 )
 
 type GKENodePoolCall struct {
 	targetLabel      string
 	projectID        string
+	conf             Config
 	error            error
 	s                *compute.Service
+	cs               *container.Service
 	ctx              context.Context
 	targetLabelValue string
 }
 
-func GKENodePool(ctx context.Context, projectID string) *GKENodePoolCall {
+func GKENodePool(ctx context.Context, projectID string, conf Config) *GKENodePoolCall {
 	s, err := compute.NewService(ctx)
 	if err != nil {
 		return &GKENodePoolCall{error: err}
 	}
+	cs, err := container.NewService(ctx)
+	if err != nil {
+		return &GKENodePoolCall{error: err}
+	}
 
 	// get all templates list
 	return &GKENodePoolCall{
 		s:         s,
+		cs:        cs,
 		projectID: projectID,
+		conf:      conf,
 		ctx:       ctx,
 	}
 }
 
-func (r *GKENodePoolCall) Filter(labelName, value string) *GKENodePoolCall {
+func (r *GKENodePoolCall) Name() string {
+	return model.GKENodePool
+}
+
+func (r *GKENodePoolCall) Filter(labelName, value string) Operator {
 	if r.error != nil {
 		return r
 	}
@@ -62,280 +68,353 @@ func (r *GKENodePoolCall) Filter(labelName, value string) *GKENodePoolCall {
 	return r
 }
 
+// Stop saves the current node pool size and autoscaling to the state store,
+// disables the autoscaling and resizes the node pools to 0
+func (r *GKENodePoolCall) Stop() (*model.Report, error) {
+	return r.Resize(0)
+}
+
+// Start resizes the node pools to the size saved in the state store and restores the autoscaling
+func (r *GKENodePoolCall) Start() (*model.Report, error) {
+	return r.Recovery()
+}
+
+// Resize sets the node count per zone of the target node pools.
+// the node pools of a cluster are changed one by one, because the cluster accepts only one operation at a time
 func (r *GKENodePoolCall) Resize(size int64) (*model.Report, error) {
 	if r.error != nil {
 		return nil, r.error
 	}
 
-	// get all instance group mangers list
-	managerList, err := compute.NewInstanceGroupManagersService(r.s).AggregatedList(r.projectID).Do()
+	clusters, skipClusters, err := r.targetClusters()
 	if err != nil {
 		return nil, err
 	}
-
-	// add instance group name of cluster node pool to Set
-	gkeNodePoolInstanceGroupSet, err := r.getGKEInstanceGroup()
+	counts, err := r.nodeCounts()
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("gkeNodePoolInstanceGroupSet:", gkeNodePoolInstanceGroupSet.ToSlice())
-
-	var res = r.error
-	var alreadyRes []string
-	var doneRes []string
-
-	for _, manager := range valuesIG(managerList.Items) {
+	w := newWorker(r.ctx, r.conf)
+	for res, reason := range skipClusters {
+		w.skip(res, reason)
+	}
 
-		fmt.Println("manager.InstanceTemplate:", manager.InstanceTemplate)
-		fmt.Println("manager.Name:", manager.Name)
+	for _, cluster := range clusters {
+		var jobs []func()
+		for _, nodePool := range cluster.NodePools {
+			name := nodePoolName(r.projectID, cluster, nodePool)
+			res := resource{ID: name, Name: cluster.Name + "/" + nodePool.Name}
+			zones := zoneCounts(nodePool, counts)
+			autoscaling := nodePool.Autoscaling != nil && nodePool.Autoscaling.Enabled
 
-		// Check GKE NodePool InstanceGroup
-		if gkeNodePoolInstanceGroupSet.Contains(manager.Name) {
-			if !manager.Status.IsStable {
+			if uniform(zones, size) && !(size == 0 && autoscaling) {
+				w.already(res)
 				continue
 			}
 
-			if manager.TargetSize == size {
-				alreadyRes = append(alreadyRes, manager.Name)
+			if r.conf.DryRun {
+				w.done(res)
 				continue
 			}
 
-			// get manager zone name
-			zoneUrlElements := strings.Split(manager.Zone, "/")
-			zone := zoneUrlElements[len(zoneUrlElements)-1]
-
-			ms := compute.NewInstanceGroupManagersService(r.s)
-			if _, err := ms.Resize(r.projectID, zone, manager.Name, size).Do(); err != nil {
-				res = multierror.Append(res, err)
-				continue
-			}
-			doneRes = append(doneRes, manager.Name)
+			cluster, nodePool := cluster, nodePool
+			jobs = append(jobs, func() {
+				if size == 0 {
+					if err := r.save(w, res, name, nodePool, zones); err != nil {
+						w.fail(res, err)
+						return
+					}
+				}
+				if size == 0 && autoscaling {
+					// the cluster autoscaler would scale out the node pool again
+					disabled := &container.NodePoolAutoscaling{ForceSendFields: []string{"Enabled"}}
+					if err := r.setAutoscaling(w, res, cluster, name, disabled); err != nil {
+						w.fail(res, err)
+						return
+					}
+				}
+				if err := r.setSize(w, res, cluster, name, size); err != nil {
+					w.fail(res, err)
+					return
+				}
+				w.done(res)
+			})
+		}
+		if len(jobs) > 0 {
+			w.run(func() {
+				for _, job := range jobs {
+					job()
+				}
+			})
 		}
-
-		time.Sleep(CallInterval)
 	}
 
-	return &model.Report{
-		InstanceType: model.GKENodePool,
-		Dones:        doneRes,
-		Alreadies:    alreadyRes,
-	}, res
+	return w.report(model.GKENodePool)
 }
 
+// Recovery resizes the target node pools to the node count saved at shutdown and restores the autoscaling
 func (r *GKENodePoolCall) Recovery() (*model.Report, error) {
 	if r.error != nil {
 		return nil, r.error
 	}
 
-	managerList, err := compute.NewInstanceGroupManagersService(r.s).AggregatedList(r.projectID).Do()
+	clusters, skipClusters, err := r.targetClusters()
 	if err != nil {
 		return nil, err
 	}
-
-	// add instance group name of cluster node pool to Set
-	gkeNodePoolInstanceGroupSet, err := r.getGKEInstanceGroup()
+	counts, err := r.nodeCounts()
 	if err != nil {
 		return nil, err
 	}
 
-	sizeMap, err := GetOriginalNodePoolSize(r.ctx, r.projectID, r.targetLabel, r.targetLabelValue)
-	if err != nil {
-		return nil, err
+	w := newWorker(r.ctx, r.conf)
+	for res, reason := range skipClusters {
+		w.skip(res, reason)
 	}
 
-	var res = r.error
-	var doneRes []string
-	var alreadyRes []string
-
-	for _, manager := range valuesIG(managerList.Items) {
+	for _, cluster := range clusters {
+		var jobs []func()
+		for _, nodePool := range cluster.NodePools {
+			name := nodePoolName(r.projectID, cluster, nodePool)
+			res := resource{ID: name, Name: cluster.Name + "/" + nodePool.Name}
+			zones := zoneCounts(nodePool, counts)
 
-		// check instance group of gke node pool
-		if gkeNodePoolInstanceGroupSet.Contains(manager.Name) {
-			if !manager.Status.IsStable {
+			saved, err := r.conf.getState(r.ctx, name)
+			if err != nil {
+				w.fail(res, err)
 				continue
 			}
-
-			split := strings.Split(manager.InstanceGroup, "/")
-			instanceGroupName := split[len(split)-1]
-
-			originalSize := sizeMap[instanceGroupName]
-
-			if manager.TargetSize == originalSize {
-				alreadyRes = append(alreadyRes, manager.Name)
+			if saved != nil {
+				w.forget(res, name)
+			} else {
+				saved = legacySize(cluster, nodePool)
+			}
+			if saved == nil {
+				if uniform(zones, 0) {
+					w.skip(res, "size at shutdown is unknown")
+				} else {
+					w.already(res)
+				}
 				continue
 			}
 
-			// get manager zone name
-			zoneUrlElements := strings.Split(manager.Zone, "/")
-			zone := zoneUrlElements[len(zoneUrlElements)-1] // ex) us-central1-a
+			// a running node pool is not resized, because the size may be changed by the user or the autoscaler
+			resizing := uniform(zones, 0)
+			restoring := saved.Autoscaler
+			if nodePool.Autoscaling != nil && nodePool.Autoscaling.Enabled {
+				restoring = nil
+			}
+			if !resizing && restoring == nil {
+				w.already(res)
+				continue
+			}
 
-			ms := compute.NewInstanceGroupManagersService(r.s)
-			if _, err := ms.Resize(r.projectID, zone, manager.Name, originalSize).Do(); err != nil {
-				res = multierror.Append(res, err)
+			if r.conf.DryRun {
+				w.done(res)
 				continue
 			}
-			doneRes = append(doneRes, manager.Name)
-		}
 
-		time.Sleep(CallInterval)
+			cluster, size := cluster, saved.TargetSize
+			jobs = append(jobs, func() {
+				if resizing {
+					if err := r.setSize(w, res, cluster, name, size); err != nil {
+						w.fail(res, err)
+						return
+					}
+				}
+				if restoring != nil {
+					enabled := &container.NodePoolAutoscaling{
+						Enabled:      true,
+						MinNodeCount: restoring.MinReplicas,
+						MaxNodeCount: restoring.MaxReplicas,
+					}
+					if err := r.setAutoscaling(w, res, cluster, name, enabled); err != nil {
+						w.fail(res, err)
+						return
+					}
+				}
+				w.done(res)
+			})
+		}
+		if len(jobs) > 0 {
+			w.run(func() {
+				for _, job := range jobs {
+					job()
+				}
+			})
+		}
 	}
 
-	return &model.Report{
-		InstanceType: model.GKENodePool,
-		Dones:        doneRes,
-		Alreadies:    alreadyRes,
-	}, res
+	return w.report(model.GKENodePool)
 }
 
-// get target GKE instance group Set
-func (r *GKENodePoolCall) getGKEInstanceGroup() (set.Set, error) {
-	s, err := container.NewService(r.ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	// get all clusters list
-	clusters, err := container.NewProjectsLocationsClustersService(s).List("projects/" + r.projectID + "/locations/-").Do()
+// get the target clusters and the protected or Autopilot cluster names with the reason
+func (r *GKENodePoolCall) targetClusters() ([]*container.Cluster, map[resource]string, error) {
+	// get all clusters list (clusters.list returns all clusters without pagination)
+	var clusters *container.ListClustersResponse
+	_, err := r.conf.retry(r.ctx, func() error {
+		var err error
+		clusters, err = container.NewProjectsLocationsClustersService(r.cs).List("projects/" + r.projectID + "/locations/-").Context(r.ctx).Do()
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	res := set.NewSet()
+	var res []*container.Cluster
+	skips := make(map[resource]string)
 	for _, cluster := range filter(clusters.Clusters, r.targetLabel, r.targetLabelValue) {
-		for _, nodePool := range cluster.NodePools {
-			for _, gkeInstanceGroup := range nodePool.InstanceGroupUrls {
-				tmpUrlElements := strings.Split(gkeInstanceGroup, "/")
-				managerTemplate := tmpUrlElements[len(tmpUrlElements)-1]
-				res.Add(managerTemplate) // e.g. gke-tky-cluster-default-pool-cb765a7d-grp
-			}
+		if reason, ok := r.conf.skipReason(cluster.ResourceLabels, r.targetLabel); ok {
+			skips[resource{ID: location(cluster) + "/" + cluster.Name, Name: cluster.Name}] = reason
+			continue
 		}
+		// the nodes of the Autopilot cluster are managed by GKE, and the node pools can't be resized
+		if cluster.Autopilot != nil && cluster.Autopilot.Enabled {
+			skips[resource{ID: location(cluster) + "/" + cluster.Name, Name: cluster.Name}] = "Autopilot cluster"
+			continue
+		}
+		res = append(res, cluster)
 	}
-	return res, nil
+	return res, skips, nil
 }
 
-func SetLableIfNoLabel(ctx context.Context, projectID, targetLabel string) error {
-	s, err := container.NewService(ctx)
+// nodeCounts returns map that key="zone/instanceGroupManagerName" and value=targetSize
+func (r *GKENodePoolCall) nodeCounts() (map[string]int64, error) {
+	managers, err := listManagers(r.ctx, r.conf, r.s, r.projectID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	currentNodeSize, err := GetCurrentNodeCount(ctx, projectID, targetLabel)
-	if err != nil {
-		return err
+
+	res := make(map[string]int64)
+	for _, manager := range managers {
+		zoneUrlElements := strings.Split(manager.Zone, "/")
+		zone := zoneUrlElements[len(zoneUrlElements)-1]
+		res[zone+"/"+manager.Name] = manager.TargetSize
 	}
-	// get all clusters list
-	clusters, err := container.NewProjectsLocationsClustersService(s).List("projects/" + projectID + "/locations/-").Do()
+	return res, nil
+}
+
+// save merges the current size and autoscaling of the node pool into the saved one.
+// the saved values are kept if the interrupted shutdown has already changed them
+func (r *GKENodePoolCall) save(w *worker, res resource, name string, nodePool *container.NodePool, zones map[string]int64) error {
+	prev, err := r.conf.getState(r.ctx, name)
 	if err != nil {
 		return err
 	}
-	for _, cluster := range filter(clusters.Clusters, targetLabel, "true") {
-		labels := cluster.ResourceLabels
-		for _, nodePool := range cluster.NodePools {
-			nodeSizeLabel := "restore-size-"+nodePool.Name
-			_, ok := labels[nodeSizeLabel]
-			if !ok {
-				// set new label
-				labels[nodeSizeLabel] = strconv.FormatInt(currentNodeSize[nodePool.Name], 10)
-			}
-		}
-		parseRegion := strings.Split(cluster.Location, "/")
-		region := parseRegion[len(parseRegion)-1]
-		name := "projects/" + projectID + "/locations/" + region + "/clusters/" + cluster.Name
-		req := &container.SetLabelsRequest{
-			ResourceLabels: labels,
-		}
-		// update labels
-		_, err := container.NewProjectsLocationsClustersService(s).SetResourceLabels(name, req).Do()
-		if err != nil {
-			return err
+	saving := shutdownSize(prev, nodePool, zones)
+	return w.exec(res, func() error {
+		return r.conf.putState(r.ctx, name, saving)
+	})
+}
+
+// shutdownSize returns the size of the node pool to save at shutdown. prev is the size saved before, or nil
+func shutdownSize(prev *Size, nodePool *container.NodePool, zones map[string]int64) *Size {
+	size := maxCount(zones)
+	if a := nodePool.Autoscaling; a != nil && a.Enabled {
+		saving := &Size{TargetSize: size, Autoscaler: &AutoscalerSize{Name: nodePool.Name, MinReplicas: a.MinNodeCount, MaxReplicas: a.MaxNodeCount}}
+		if size == 0 && prev != nil {
+			saving.TargetSize = prev.TargetSize
 		}
+		return saving
 	}
-	return nil
+	// the interrupted shutdown saved the size and disabled the autoscaling, but failed to resize the node pool.
+	// otherwise the autoscaling was disabled by the user and is not enabled by the start
+	if prev != nil && prev.TargetSize == size {
+		return &Size{TargetSize: size, Autoscaler: prev.Autoscaler}
+	}
+	return &Size{TargetSize: size}
 }
 
-
-// GetOriginalNodePoolSize returns map that key=instanceGroupName and value=originalSize
-func GetOriginalNodePoolSize(ctx context.Context, projectID, targetLabel, labelValue string) (map[string]int64, error) {
-	s, err := container.NewService(ctx)
+// setSize sets the node count per zone of the node pool and waits for the operation
+func (r *GKENodePoolCall) setSize(w *worker, res resource, cluster *container.Cluster, name string, size int64) error {
+	req := &container.SetNodePoolSizeRequest{NodeCount: size, ForceSendFields: []string{"NodeCount"}}
+	var op *container.Operation
+	err := w.exec(res, func() error {
+		var err error
+		op, err = container.NewProjectsLocationsClustersNodePoolsService(r.cs).SetSize(name, req).Context(r.ctx).Do()
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return waitContainerOperation(r.ctx, r.conf, r.cs, r.projectID, location(cluster), op)
+}
 
-	// get all clusters list
-	clusters, err := container.NewProjectsLocationsClustersService(s).List("projects/" + projectID + "/locations/-").Do()
+// setAutoscaling updates the autoscaling of the node pool and waits for the operation
+func (r *GKENodePoolCall) setAutoscaling(w *worker, res resource, cluster *container.Cluster, name string, a *container.NodePoolAutoscaling) error {
+	req := &container.SetNodePoolAutoscalingRequest{Autoscaling: a}
+	var op *container.Operation
+	err := w.exec(res, func() error {
+		var err error
+		op, err = container.NewProjectsLocationsClustersNodePoolsService(r.cs).SetAutoscaling(name, req).Context(r.ctx).Do()
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return waitContainerOperation(r.ctx, r.conf, r.cs, r.projectID, location(cluster), op)
+}
 
-	result := make(map[string]int64)
-
-	for _, cluster := range filter(clusters.Clusters, targetLabel, labelValue) {
-		labels := cluster.ResourceLabels
-		for _, nodePool := range cluster.NodePools {
-			restoreSize, ok := labels["restore-size-"+nodePool.Name]
-			if !ok {
-				continue
-			}
-
-			size, err := strconv.Atoi(restoreSize)
-			if err != nil {
-				return nil, errors.New("label: " + "restore-size-" + nodePool.Name + " value is not number format?")
-			}
-
-			for _, url := range nodePool.InstanceGroupUrls {
-				// u;rl is below format
-				// e.g. https://www.googleapis.com/compute/v1/projects/{ProjectID}/zones/us-central1-a/instanceGroupManagers/gke-standard-cluster-1-default-pool-1234abcd-grp
-				urlSplit := strings.Split(url, "/")
-				instanceGroupName := urlSplit[len(urlSplit)-1]
-				result[instanceGroupName] = int64(size)
-			}
+// zoneCounts returns map that key=zone and value=node count of the node pool
+func zoneCounts(nodePool *container.NodePool, counts map[string]int64) map[string]int64 {
+	res := make(map[string]int64)
+	for _, url := range nodePool.InstanceGroupUrls {
+		// e.g. https://www.googleapis.com/compute/v1/projects/{ProjectID}/zones/us-central1-a/instanceGroupManagers/gke-standard-cluster-1-default-pool-1234abcd-grp
+		urlSplit := strings.Split(url, "/")
+		if len(urlSplit) < 4 {
+			continue
 		}
+		zone, name := urlSplit[len(urlSplit)-3], urlSplit[len(urlSplit)-1]
+		res[zone] = counts[zone+"/"+name]
 	}
+	return res
+}
 
-	return result, nil
+// uniform reports whether all zones have the node count
+func uniform(zones map[string]int64, count int64) bool {
+	for _, c := range zones {
+		if c != count {
+			return false
+		}
+	}
+	return true
 }
 
-// GetCurrentNodeCount returns map that key=NodePoolName and value=currentSize
-func GetCurrentNodeCount(ctx context.Context, projectID, targetLabel string) (map[string]int64, error) {
-	s, err := container.NewService(ctx)
-	if err != nil {
-		return nil, err
+// maxCount returns the largest node count of the zones.
+// setSize applies the same count to every zone, so no zone runs fewer nodes than before at restart
+func maxCount(zones map[string]int64) int64 {
+	var res int64
+	for _, c := range zones {
+		if c > res {
+			res = c
+		}
 	}
-	computeService, err := compute.NewService(ctx)
-	if err != nil {
-		return nil, err
+	return res
+}
+
+// legacySize returns the size saved in the cluster label "restore-size-<node pool>" by the older version, or nil
+func legacySize(cluster *container.Cluster, nodePool *container.NodePool) *Size {
+	v, ok := cluster.ResourceLabels["restore-size-"+nodePool.Name]
+	if !ok {
+		return nil
 	}
-	// get all clusters list
-	clusters, err := container.NewProjectsLocationsClustersService(s).List("projects/" + projectID + "/locations/-").Do()
+	size, err := strconv.ParseInt(v, 10, 64)
 	if err != nil {
-		return nil, err
+		return nil
 	}
+	return &Size{TargetSize: size}
+}
 
-	result := make(map[string]int64)
-
-	reZone := regexp.MustCompile(".*/zones/")
-	reInstance := regexp.MustCompile(".*/instanceGroupManagers/")
-	reEtc := regexp.MustCompile("/.*")
+// nodePoolName returns the resource name of the node pool, which is also the key in the state store
+func nodePoolName(projectID string, cluster *container.Cluster, nodePool *container.NodePool) string {
+	return "projects/" + projectID + "/locations/" + location(cluster) + "/clusters/" + cluster.Name + "/nodePools/" + nodePool.Name
+}
 
-	for _, cluster := range filter(clusters.Clusters, targetLabel, "true") {
-		for _, nodePool := range cluster.NodePools {
-			// nodePool.InstanceGroupUrls's format is below
-			// ["https://www.googleapis.com/compute/v1/projects/<projectID>/zones/<zone1>/instanceGroupManagers/gke-test-scheduler-2-default-pool-2b19b588-grp", 
-			//  "https://www.googleapis.com/compute/v1/projects/<projectID>/zones/<zone2>/instanceGroupManagers/gke-test-scheduler-2-default-pool-2b19b588-grp",
-			//  "https://www.googleapis.com/compute/v1/projects/<projectID>/zones/<zone3>/instanceGroupManagers/gke-test-scheduler-2-default-pool-2b19b588-grp"]
-
-			zone := reZone.ReplaceAllString(nodePool.InstanceGroupUrls[0], "")//"<zone1>/instanceGroupManagers/gke-test-scheduler-2-default-pool-2b19b588-grp"
-			zone = reEtc.ReplaceAllString(zone, "")//"<zone1>
-			instanceGroup := reInstance.ReplaceAllString(nodePool.InstanceGroupUrls[0], "")
-			resp, err := computeService.InstanceGroups.Get(projectID, zone, instanceGroup).Context(ctx).Do()
-			if err != nil {
-				return nil, err
-			}
-			size := resp.Size
-			result[nodePool.Name] = size
-		}
-	}
-	return result, nil
+// location returns the zone or the region of the cluster
+func location(cluster *container.Cluster) string {
+	parseRegion := strings.Split(cluster.Location, "/")
+	return parseRegion[len(parseRegion)-1]
 }
 
 // grep target cluster and create target cluster list
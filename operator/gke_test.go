@@ -0,0 +1,49 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/container/v1"
+)
+
+func TestShutdownSize(t *testing.T) {
+	enabled := &container.NodePool{Name: "pool", Autoscaling: &container.NodePoolAutoscaling{Enabled: true, MinNodeCount: 1, MaxNodeCount: 5}}
+	disabled := &container.NodePool{Name: "pool", Autoscaling: &container.NodePoolAutoscaling{}}
+	saved := &Size{TargetSize: 3, Autoscaler: &AutoscalerSize{Name: "pool", MinReplicas: 1, MaxReplicas: 4}}
+	tests := []struct {
+		name     string
+		prev     *Size
+		nodePool *container.NodePool
+		zones    map[string]int64
+		want     *Size
+	}{
+		{"autoscaling", nil, enabled, map[string]int64{"a": 2, "b": 3}, &Size{TargetSize: 3, Autoscaler: &AutoscalerSize{Name: "pool", MinReplicas: 1, MaxReplicas: 5}}},
+		{"autoscaling at 0", saved, enabled, map[string]int64{"a": 0}, &Size{TargetSize: 3, Autoscaler: &AutoscalerSize{Name: "pool", MinReplicas: 1, MaxReplicas: 5}}},
+		{"no autoscaling", nil, &container.NodePool{Name: "pool"}, map[string]int64{"a": 2}, &Size{TargetSize: 2}},
+		{"interrupted shutdown", saved, disabled, map[string]int64{"a": 3, "b": 3}, saved},
+		{"disabled by the user", saved, disabled, map[string]int64{"a": 2}, &Size{TargetSize: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shutdownSize(tt.prev, tt.nodePool, tt.zones); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("shutdownSize() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
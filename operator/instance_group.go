@@ -18,47 +18,51 @@ package operator
 import (
 	set "github.com/deckarep/golang-set"
 	"github.com/future-architect/gcp-instance-scheduler/model"
-	"github.com/hashicorp/go-multierror"
 	"golang.org/x/net/context"
 	"google.golang.org/api/compute/v1"
 	"strings"
-	"time"
 )
 
+// AutoscalerModeOff is the autoscaler mode which never scales the group in or out.
+// the autoscaler of a stopped group is turned off, because it would scale out the group again
+const AutoscalerModeOff = "OFF"
+
+// GKENodeLabel is the label which GKE sets to the instance templates of the node pools.
+// the groups are resized with the node pool by GKENodePoolCall, not by InstanceGroupCall
+const GKENodeLabel = "goog-gke-node"
+
 type InstanceGroupCall struct {
-	instanceGroupList *compute.InstanceGroupManagerAggregatedList
-	templateListCall  *compute.InstanceTemplatesListCall
-	targetLabel       string
-	targetLabelValue  string
-	projectID         string
-	error             error
-	s                 *compute.Service
-	ctx               context.Context
+	templateListCall *compute.InstanceTemplatesListCall
+	targetLabel      string
+	targetLabelValue string
+	projectID        string
+	conf             Config
+	error            error
+	s                *compute.Service
+	ctx              context.Context
 }
 
-func InstanceGroup(ctx context.Context, projectID string) *InstanceGroupCall {
+func InstanceGroup(ctx context.Context, projectID string, conf Config) *InstanceGroupCall {
 	s, err := compute.NewService(ctx)
 	if err != nil {
 		return &InstanceGroupCall{error: err}
 	}
 
-	// get all instance group mangers list
-	managerList, err := compute.NewInstanceGroupManagersService(s).AggregatedList(projectID).Do()
-	if err != nil {
-		return &InstanceGroupCall{error: err}
-	}
-
 	// get all templates list
 	return &InstanceGroupCall{
-		s:                 s,
-		templateListCall:  compute.NewInstanceTemplatesService(s).List(projectID),
-		instanceGroupList: managerList,
-		projectID:         projectID,
-		ctx:               ctx,
+		s:                s,
+		templateListCall: compute.NewInstanceTemplatesService(s).List(projectID),
+		projectID:        projectID,
+		conf:             conf,
+		ctx:              ctx,
 	}
 }
 
-func (r *InstanceGroupCall) Filter(labelName, value string) *InstanceGroupCall {
+func (r *InstanceGroupCall) Name() string {
+	return model.InstanceGroup
+}
+
+func (r *InstanceGroupCall) Filter(labelName, value string) Operator {
 	if r.error != nil {
 		return r
 	}
@@ -68,24 +72,43 @@ func (r *InstanceGroupCall) Filter(labelName, value string) *InstanceGroupCall {
 	return r
 }
 
+// Stop resizes the target instance groups to 0
+func (r *InstanceGroupCall) Stop() (*model.Report, error) {
+	return r.Resize(0)
+}
+
+// Start resizes the target instance groups to the original size
+func (r *InstanceGroupCall) Start() (*model.Report, error) {
+	return r.Recovery()
+}
+
 func (r *InstanceGroupCall) Resize(size int64) (*model.Report, error) {
 	if r.error != nil {
 		return nil, r.error
 	}
 
-	templateList, err := r.templateListCall.Do()
+	templates, err := r.listTemplates()
 	if err != nil {
 		return nil, err
 	}
+	skipTemplates := r.skipTemplates(templates)
 
-	var res = r.error
-	var doneRes []string
-	var alreadyRes []string
+	// get all instance group mangers list
+	managers, err := listManagers(r.ctx, r.conf, r.s, r.projectID)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, manager := range valuesIG(r.instanceGroupList.Items) {
-		// get manager zone name
-		zoneUrlElements := strings.Split(manager.Zone, "/")
-		zone := zoneUrlElements[len(zoneUrlElements)-1]
+	autoscalers, err := listAutoscalers(r.ctx, r.conf, r.s, r.projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+
+	for _, manager := range managers {
+		location, _ := groupLocation(manager)
+		res := resource{ID: location + "/" + manager.Name, Name: manager.Name}
 
 		// get manager's template name
 		tmpUrlElements := strings.Split(manager.InstanceTemplate, "/")
@@ -93,37 +116,64 @@ func (r *InstanceGroupCall) Resize(size int64) (*model.Report, error) {
 
 		// add instance group name to Set
 		instanceGroupSet := set.NewSet()
-		for _, t := range templateList.Items {
+		for _, t := range templates {
 			instanceGroupSet.Add(t.Name)
 		}
 
 		// compare filtered instance template name and manager which is created by template
 		if instanceGroupSet.Contains(managerTemplate) {
+			if reason, ok := skipTemplates[managerTemplate]; ok {
+				w.skip(res, reason)
+				continue
+			}
+
 			if !manager.Status.IsStable {
 				continue
 			}
 
 			if manager.TargetSize == 0 {
-				alreadyRes = append(alreadyRes, manager.Name)
+				w.already(res)
 				continue
 			}
 
-			ms := compute.NewInstanceGroupManagersService(r.s)
-			if _, err := ms.Resize(r.projectID, zone, manager.Name, size).Do(); err != nil {
-				res = multierror.Append(res, err)
+			if r.conf.DryRun {
+				w.done(res)
 				continue
 			}
-			doneRes = append(doneRes, manager.Name)
-		}
 
-		time.Sleep(CallInterval)
+			saving := &Size{TargetSize: manager.TargetSize}
+			if a, ok := autoscalers[manager.SelfLink]; ok && a.AutoscalingPolicy != nil {
+				if mode := a.AutoscalingPolicy.Mode; mode == AutoscalerModeOff {
+					// turned off by the interrupted shutdown (or by the user). keep the saved mode
+					prev, err := savedSize(r.ctx, r.conf, r.projectID, manager)
+					if err != nil {
+						w.fail(res, err)
+						continue
+					}
+					if prev != nil {
+						saving.Autoscaler = prev.Autoscaler
+					}
+				} else {
+					saving.Autoscaler = &AutoscalerSize{Name: a.Name, Mode: mode}
+				}
+			}
+			manager := manager
+			w.call(res, func() (func() error, error) {
+				if err := saveSize(r.ctx, r.conf, r.projectID, manager, saving); err != nil {
+					return nil, err
+				}
+				// the autoscaler would scale out the group again
+				if saving.Autoscaler != nil {
+					if err := setAutoscaler(r.ctx, r.conf, r.s, r.projectID, manager, saving.Autoscaler.Name, AutoscalerModeOff); err != nil {
+						return nil, err
+					}
+				}
+				return resizeGroup(r.ctx, r.conf, r.s, r.projectID, manager, size)
+			})
+		}
 	}
 
-	return &model.Report{
-		InstanceType: model.InstanceGroup,
-		Dones:        doneRes,
-		Alreadies:    alreadyRes,
-	}, res
+	return w.report(model.InstanceGroup)
 }
 
 func (r *InstanceGroupCall) Recovery() (*model.Report, error) {
@@ -131,31 +181,34 @@ func (r *InstanceGroupCall) Recovery() (*model.Report, error) {
 		return nil, r.error
 	}
 
-	templateList, err := r.templateListCall.Do()
+	templates, err := r.listTemplates()
 	if err != nil {
 		return nil, err
 	}
+	skipTemplates := r.skipTemplates(templates)
 
-	// add instance group name to Set
-	// NodePool that belong to GKE which has target label
-	targetInstanceGroupSet := set.NewSet()
-	for _, t := range templateList.Items {
-		targetInstanceGroupSet.Add(t.Name)
+	// get all instance group mangers list
+	managers, err := listManagers(r.ctx, r.conf, r.s, r.projectID)
+	if err != nil {
+		return nil, err
 	}
 
-	sizeMap, err := GetOriginalNodePoolSize(r.ctx, r.projectID, r.targetLabel, r.targetLabelValue)
+	autoscalers, err := listAutoscalers(r.ctx, r.conf, r.s, r.projectID)
 	if err != nil {
 		return nil, err
 	}
 
-	var res = r.error
-	var doneRes []string
-	var alreadyRes []string
+	// add instance group name to Set
+	targetInstanceGroupSet := set.NewSet()
+	for _, t := range templates {
+		targetInstanceGroupSet.Add(t.Name)
+	}
+
+	w := newWorker(r.ctx, r.conf)
 
-	for _, manager := range valuesIG(r.instanceGroupList.Items) {
-		// get manager zone name
-		zoneUrlElements := strings.Split(manager.Zone, "/")
-		zone := zoneUrlElements[len(zoneUrlElements)-1] // ex) us-central1-a
+	for _, manager := range managers {
+		location, _ := groupLocation(manager) // ex) us-central1-a or us-central1
+		res := resource{ID: location + "/" + manager.Name, Name: manager.Name}
 
 		// get manager's template name
 		tmpUrlElements := strings.Split(manager.InstanceTemplate, "/")
@@ -163,36 +216,202 @@ func (r *InstanceGroupCall) Recovery() (*model.Report, error) {
 
 		// compare filtered instance template name and manager which is created by template
 		if targetInstanceGroupSet.Contains(instanceTemplateName) {
-			if !manager.Status.IsStable {
+			if reason, ok := skipTemplates[instanceTemplateName]; ok {
+				w.skip(res, reason)
 				continue
 			}
 
-			split := strings.Split(manager.InstanceGroup, "/")
-			instanceGroupName := split[len(split)-1]
+			if !manager.Status.IsStable {
+				continue
+			}
 
-			originalSize := sizeMap[instanceGroupName]
+			saved, err := savedSize(r.ctx, r.conf, r.projectID, manager)
+			if err != nil {
+				w.fail(res, err)
+				continue
+			}
+			if saved == nil {
+				if manager.TargetSize == 0 {
+					w.skip(res, "size at shutdown is unknown")
+				} else {
+					w.already(res)
+				}
+				continue
+			}
+			w.forget(res, groupKey(r.projectID, manager))
+			originalSize := saved.TargetSize
+
+			// the autoscaler is restored if it still has another mode than the saved one
+			restoring := saved.Autoscaler
+			if restoring != nil {
+				a, ok := autoscalers[manager.SelfLink]
+				if !ok || a.AutoscalingPolicy == nil || restoring.Mode == "" || a.AutoscalingPolicy.Mode == restoring.Mode {
+					restoring = nil
+				}
+			}
 
-			if manager.TargetSize == originalSize {
-				alreadyRes = append(alreadyRes, manager.Name)
+			// a running group is not resized, because the size may be changed by the user or the autoscaler
+			resizing := manager.TargetSize == 0
+			if !resizing && restoring == nil {
+				w.already(res)
 				continue
 			}
 
-			ms := compute.NewInstanceGroupManagersService(r.s)
-			if _, err := ms.Resize(r.projectID, zone, manager.Name, originalSize).Do(); err != nil {
-				res = multierror.Append(res, err)
+			if r.conf.DryRun {
+				w.done(res)
 				continue
 			}
-			doneRes = append(doneRes, manager.Name)
+
+			manager := manager
+			w.call(res, func() (func() error, error) {
+				// the autoscaler owns the size once it is turned on, so the group is resized before it
+				if resizing {
+					wait, err := resizeGroup(r.ctx, r.conf, r.s, r.projectID, manager, originalSize)
+					if err != nil || restoring == nil {
+						return wait, err
+					}
+					if err := wait(); err != nil {
+						return nil, err
+					}
+				}
+				if err := setAutoscaler(r.ctx, r.conf, r.s, r.projectID, manager, restoring.Name, restoring.Mode); err != nil {
+					return nil, err
+				}
+				return nil, nil
+			})
+		}
+	}
+
+	return w.report(model.InstanceGroup)
+}
+
+// saveSize saves the size of the managed instance group before shutdown
+func saveSize(ctx context.Context, conf Config, projectID string, manager *compute.InstanceGroupManager, size *Size) error {
+	return conf.putState(ctx, groupKey(projectID, manager), size)
+}
+
+// savedSize returns the size of the managed instance group saved at shutdown, or nil if unknown
+func savedSize(ctx context.Context, conf Config, projectID string, manager *compute.InstanceGroupManager) (*Size, error) {
+	return conf.getState(ctx, groupKey(projectID, manager))
+}
+
+// groupKey returns the key of the zonal or regional managed instance group in the state store
+func groupKey(projectID string, manager *compute.InstanceGroupManager) string {
+	location, regional := groupLocation(manager)
+	if regional {
+		return regionStateKey(projectID, location, manager.Name)
+	}
+	return stateKey(projectID, location, manager.Name)
+}
+
+// groupLocation returns the zone of the zonal group, or the region and true of the regional group
+func groupLocation(manager *compute.InstanceGroupManager) (string, bool) {
+	if manager.Zone == "" {
+		urlElements := strings.Split(manager.Region, "/")
+		return urlElements[len(urlElements)-1], true
+	}
+	urlElements := strings.Split(manager.Zone, "/")
+	return urlElements[len(urlElements)-1], false
+}
+
+// resizeGroup resizes the zonal or regional managed instance group, and returns the function which waits for the operation
+func resizeGroup(ctx context.Context, conf Config, s *compute.Service, projectID string, manager *compute.InstanceGroupManager, size int64) (func() error, error) {
+	location, regional := groupLocation(manager)
+	if regional {
+		op, err := compute.NewRegionInstanceGroupManagersService(s).Resize(projectID, location, manager.Name, size).Context(ctx).Do()
+		if err != nil {
+			return nil, err
 		}
+		return waitRegion(ctx, conf, s, projectID, location, op), nil
+	}
+	op, err := compute.NewInstanceGroupManagersService(s).Resize(projectID, location, manager.Name, size).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return waitZone(ctx, conf, s, projectID, location, op), nil
+}
 
-		time.Sleep(CallInterval)
+// skipTemplates returns map that key=templateName and value=reason of the protected templates and the GKE node templates
+func (r *InstanceGroupCall) skipTemplates(templates []*compute.InstanceTemplate) map[string]string {
+	res := make(map[string]string)
+	for _, t := range templates {
+		if t.Properties == nil {
+			continue
+		}
+		// the node templates have the labels of the cluster, so they match the target label with the cluster
+		if _, ok := t.Properties.Labels[GKENodeLabel]; ok {
+			res[t.Name] = "managed by GKE node pool"
+			continue
+		}
+		if reason, ok := r.conf.skipReason(t.Properties.Labels, r.targetLabel); ok {
+			res[t.Name] = reason
+		}
 	}
+	return res
+}
+
+// list the target instance templates of all pages
+func (r *InstanceGroupCall) listTemplates() ([]*compute.InstanceTemplate, error) {
+	var res []*compute.InstanceTemplate
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = nil
+		return r.templateListCall.Pages(r.ctx, func(list *compute.InstanceTemplateList) error {
+			res = append(res, list.Items...)
+			return nil
+		})
+	})
+	return res, err
+}
 
-	return &model.Report{
-		InstanceType: model.InstanceGroup,
-		Dones:        doneRes,
-		Alreadies:    alreadyRes,
-	}, res
+// list all zonal and regional instance group managers at the project
+func listManagers(ctx context.Context, conf Config, s *compute.Service, projectID string) ([]*compute.InstanceGroupManager, error) {
+	var res []*compute.InstanceGroupManager
+	_, err := conf.retry(ctx, func() error {
+		res = nil
+		return compute.NewInstanceGroupManagersService(s).AggregatedList(projectID).Pages(ctx, func(list *compute.InstanceGroupManagerAggregatedList) error {
+			res = append(res, valuesIG(list.Items)...)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// listAutoscalers returns map that key=target instance group manager URL and value=autoscaler
+func listAutoscalers(ctx context.Context, conf Config, s *compute.Service, projectID string) (map[string]*compute.Autoscaler, error) {
+	var res map[string]*compute.Autoscaler
+	_, err := conf.retry(ctx, func() error {
+		res = make(map[string]*compute.Autoscaler)
+		return compute.NewAutoscalersService(s).AggregatedList(projectID).Pages(ctx, func(list *compute.AutoscalerAggregatedList) error {
+			for _, scopedList := range list.Items {
+				for _, a := range scopedList.Autoscalers {
+					res[a.Target] = a
+				}
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+// setAutoscaler sets the mode of the autoscaler of the zonal or regional group and waits for the operation.
+// the other fields of the policy are kept by the patch
+func setAutoscaler(ctx context.Context, conf Config, s *compute.Service, projectID string, manager *compute.InstanceGroupManager, name, mode string) error {
+	a := &compute.Autoscaler{
+		AutoscalingPolicy: &compute.AutoscalingPolicy{Mode: mode},
+	}
+	location, regional := groupLocation(manager)
+	if regional {
+		op, err := compute.NewRegionAutoscalersService(s).Patch(projectID, location, a).Autoscaler(name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		return waitRegionOperation(ctx, conf, s, projectID, location, op)
+	}
+	op, err := compute.NewAutoscalersService(s).Patch(projectID, location, a).Autoscaler(name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	return waitZoneOperation(ctx, conf, s, projectID, location, op)
 }
 
 // create instance group manager list
@@ -0,0 +1,302 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestSkipTemplates(t *testing.T) {
+	r := &InstanceGroupCall{targetLabel: "state-scheduler"}
+	templates := []*compute.InstanceTemplate{
+		{Name: "web", Properties: &compute.InstanceProperties{Labels: map[string]string{"state-scheduler": "true"}}},
+		{Name: "gke-dev-default-pool-1a2b3c4d", Properties: &compute.InstanceProperties{Labels: map[string]string{"state-scheduler": "true", GKENodeLabel: ""}}},
+		{Name: "batch"},
+	}
+	got := r.skipTemplates(templates)
+	if len(got) != 1 || got["gke-dev-default-pool-1a2b3c4d"] != "managed by GKE node pool" {
+		t.Errorf("skipTemplates() = %v, want the GKE node template only", got)
+	}
+}
+
+// memoryStore is the state store on memory
+type memoryStore struct {
+	mu    sync.Mutex
+	sizes map[string]*Size
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (*Size, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizes[key], nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, key string, size *Size) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sizes[key] = size
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sizes, key)
+	return nil
+}
+
+// fakeCompute serves the instance templates, the instance group managers and the autoscalers of the project "p"
+type fakeCompute struct {
+	mu       sync.Mutex
+	managers map[string]*compute.InstanceGroupManager
+	modes    map[string]string
+}
+
+func (f *fakeCompute) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/projects/p/")
+	switch {
+	case req.Method == http.MethodGet && path == "global/instanceTemplates":
+		f.write(rw, &compute.InstanceTemplateList{Items: []*compute.InstanceTemplate{
+			{Name: "web", Properties: &compute.InstanceProperties{Labels: map[string]string{"state-scheduler": "true"}}},
+		}})
+	case req.Method == http.MethodGet && path == "aggregated/instanceGroupManagers":
+		items := make(map[string]compute.InstanceGroupManagersScopedList)
+		for _, m := range f.managers {
+			scope := m.Zone
+			if scope == "" {
+				scope = m.Region
+			}
+			list := items[scope]
+			list.InstanceGroupManagers = append(list.InstanceGroupManagers, m)
+			items[scope] = list
+		}
+		f.write(rw, &compute.InstanceGroupManagerAggregatedList{Items: items})
+	case req.Method == http.MethodGet && path == "aggregated/autoscalers":
+		var autoscalers []*compute.Autoscaler
+		for name, mode := range f.modes {
+			autoscalers = append(autoscalers, &compute.Autoscaler{
+				Name:              name,
+				Target:            f.managers[name].SelfLink,
+				AutoscalingPolicy: &compute.AutoscalingPolicy{Mode: mode, MinNumReplicas: 1, MaxNumReplicas: 5},
+			})
+		}
+		f.write(rw, &compute.AutoscalerAggregatedList{Items: map[string]compute.AutoscalersScopedList{
+			"zones/asia-northeast1-a": {Autoscalers: autoscalers},
+		}})
+	case req.Method == http.MethodPatch && strings.HasSuffix(path, "/autoscalers"):
+		var a compute.Autoscaler
+		if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.modes[req.URL.Query().Get("autoscaler")] = a.AutoscalingPolicy.Mode
+		f.write(rw, &compute.Operation{Name: "op", Status: "DONE"})
+	case req.Method == http.MethodPost && strings.HasSuffix(path, "/resize"):
+		elements := strings.Split(path, "/")
+		size, err := strconv.ParseInt(req.URL.Query().Get("size"), 10, 64)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := elements[len(elements)-2]
+		// the autoscaler which is not turned off owns the size
+		if mode, ok := f.modes[name]; ok && mode != AutoscalerModeOff {
+			http.Error(rw, "the group is managed by the autoscaler", http.StatusBadRequest)
+			return
+		}
+		f.managers[name].TargetSize = size
+		f.write(rw, &compute.Operation{Name: "op", Status: "DONE"})
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (f *fakeCompute) write(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (f *fakeCompute) size(name string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.managers[name].TargetSize
+}
+
+func (f *fakeCompute) setSize(name string, size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.managers[name].TargetSize = size
+}
+
+func (f *fakeCompute) mode(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.modes[name]
+}
+
+func newManager(name, zone, region string, size int64) *compute.InstanceGroupManager {
+	scope := "zones/" + zone
+	if zone == "" {
+		scope = "regions/" + region
+	}
+	m := &compute.InstanceGroupManager{
+		Name:             name,
+		InstanceTemplate: "https://www.googleapis.com/compute/v1/projects/p/global/instanceTemplates/web",
+		SelfLink:         "https://www.googleapis.com/compute/v1/projects/p/" + scope + "/instanceGroupManagers/" + name,
+		Status:           &compute.InstanceGroupManagerStatus{IsStable: true},
+		TargetSize:       size,
+	}
+	if zone != "" {
+		m.Zone = "https://www.googleapis.com/compute/v1/projects/p/zones/" + zone
+	} else {
+		m.Region = "https://www.googleapis.com/compute/v1/projects/p/regions/" + region
+	}
+	return m
+}
+
+func TestInstanceGroupRoundTrip(t *testing.T) {
+	f := &fakeCompute{
+		managers: map[string]*compute.InstanceGroupManager{
+			"web":      newManager("web", "asia-northeast1-a", "", 3),
+			"web-ha":   newManager("web-ha", "", "asia-northeast1", 6),
+			"web-idle": newManager("web-idle", "asia-northeast1-b", "", 0),
+			"batch":    newManager("batch", "asia-northeast1-b", "", 2),
+		},
+		modes: map[string]string{"web": "ON"},
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ctx := context.Background()
+	s, err := compute.NewService(ctx, option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryStore{sizes: make(map[string]*Size)}
+	call := func() Operator {
+		r := &InstanceGroupCall{
+			s:                s,
+			templateListCall: compute.NewInstanceTemplatesService(s).List("p"),
+			projectID:        "p",
+			conf:             Config{Wait: true, State: store},
+			ctx:              ctx,
+		}
+		return r.Filter("state-scheduler", "true")
+	}
+
+	report, err := call().Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sorted(report.Dones); !reflect.DeepEqual(got, []string{"batch", "web", "web-ha"}) {
+		t.Errorf("Stop() Dones = %v, want [batch web web-ha]", got)
+	}
+	if got := report.Alreadies; !reflect.DeepEqual(got, []string{"web-idle"}) {
+		t.Errorf("Stop() Alreadies = %v, want [web-idle]", got)
+	}
+	if f.size("web") != 0 || f.size("web-ha") != 0 || f.mode("web") != AutoscalerModeOff {
+		t.Errorf("after Stop() web=%d (%s) web-ha=%d, want 0 (OFF) 0", f.size("web"), f.mode("web"), f.size("web-ha"))
+	}
+	want := map[string]*Size{
+		"projects/p/zones/asia-northeast1-a/instanceGroupManagers/web":    {TargetSize: 3, Autoscaler: &AutoscalerSize{Name: "web", Mode: "ON"}},
+		"projects/p/regions/asia-northeast1/instanceGroupManagers/web-ha": {TargetSize: 6},
+		"projects/p/zones/asia-northeast1-b/instanceGroupManagers/batch":  {TargetSize: 2},
+	}
+	if !reflect.DeepEqual(store.sizes, want) {
+		t.Errorf("saved sizes = %v, want %v", store.sizes, want)
+	}
+
+	// the group scaled out by the user before the start is not changed
+	f.setSize("batch", 5)
+
+	report, err = call().Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sorted(report.Dones); !reflect.DeepEqual(got, []string{"web", "web-ha"}) {
+		t.Errorf("Start() Dones = %v, want [web web-ha]", got)
+	}
+	if got := report.Alreadies; !reflect.DeepEqual(got, []string{"batch"}) {
+		t.Errorf("Start() Alreadies = %v, want [batch]", got)
+	}
+	// the size of the group which was stopped before the shutdown is unknown
+	if got := report.Skips; !reflect.DeepEqual(got, []string{"web-idle (size at shutdown is unknown)"}) {
+		t.Errorf("Start() Skips = %v, want [web-idle (size at shutdown is unknown)]", got)
+	}
+	if f.size("web") != 3 || f.size("web-ha") != 6 || f.mode("web") != "ON" {
+		t.Errorf("after Start() web=%d (%s) web-ha=%d, want 3 (ON) 6", f.size("web"), f.mode("web"), f.size("web-ha"))
+	}
+	if f.size("batch") != 5 {
+		t.Errorf("after Start() batch=%d, want 5", f.size("batch"))
+	}
+	// the restored sizes are deleted, and saved again at the next shutdown
+	if len(store.sizes) != 0 {
+		t.Errorf("saved sizes after Start() = %v, want none", store.sizes)
+	}
+
+	// the repeated start changes nothing
+	report, err = call().Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Dones) != 0 {
+		t.Errorf("second Start() Dones = %v, want none", report.Dones)
+	}
+
+	// the group scaled down to 0 by the user during the day is not restored to the old size
+	f.setSize("web-ha", 0)
+
+	report, err = call().Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sorted(report.Alreadies); !reflect.DeepEqual(got, []string{"web-ha", "web-idle"}) {
+		t.Errorf("third Stop() Alreadies = %v, want [web-ha web-idle]", got)
+	}
+	report, err = call().Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sorted(report.Skips); !reflect.DeepEqual(got, []string{"web-ha (size at shutdown is unknown)", "web-idle (size at shutdown is unknown)"}) {
+		t.Errorf("third Start() Skips = %v, want web-ha and web-idle", got)
+	}
+	if f.size("web-ha") != 0 {
+		t.Errorf("after third Start() web-ha=%d, want 0", f.size("web-ha"))
+	}
+}
+
+func sorted(l []string) []string {
+	res := append([]string(nil), l...)
+	sort.Strings(res)
+	return res
+}
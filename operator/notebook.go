@@ -0,0 +1,257 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/future-architect/gcp-instance-scheduler/model"
+	"golang.org/x/net/context"
+	notebooks "google.golang.org/api/notebooks/v1"
+	notebooksv2 "google.golang.org/api/notebooks/v2"
+)
+
+// NotebookMetadata is the metadata key which the notebooks API sets to the VMs of the user-managed notebooks
+// and the Workbench instances. the VMs are stopped and started with the notebooks, not by ComputeEngineCall
+const NotebookMetadata = "notebooks-api"
+
+// NotebookCall stops and starts the Vertex AI Workbench instances.
+// the user-managed notebooks are listed by the notebooks v1 API, and the Workbench instances by the v2 API
+type NotebookCall struct {
+	s           *notebooks.Service
+	v2          *notebooksv2.Service
+	targetLabel string
+	value       string
+	projectID   string
+	conf        Config
+	error       error
+	ctx         context.Context
+}
+
+// notebook is the instance of the notebooks v1 or v2 API
+type notebook struct {
+	name   string
+	state  string
+	labels map[string]string
+	v2     bool
+}
+
+func Notebook(ctx context.Context, projectID string, conf Config) *NotebookCall {
+	s, err := notebooks.NewService(ctx)
+	if err != nil {
+		return &NotebookCall{error: err}
+	}
+	v2, err := notebooksv2.NewService(ctx)
+	if err != nil {
+		return &NotebookCall{error: err}
+	}
+
+	return &NotebookCall{
+		s:         s,
+		v2:        v2,
+		projectID: projectID,
+		conf:      conf,
+		ctx:       ctx,
+	}
+}
+
+func (r *NotebookCall) Name() string {
+	return model.Notebook
+}
+
+// Filter narrows down the instances after listing, because the list API has no filter
+func (r *NotebookCall) Filter(labelName, value string) Operator {
+	if r.error != nil {
+		return r
+	}
+	r.targetLabel = labelName
+	r.value = value
+	return r
+}
+
+func (r *NotebookCall) Stop() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	instances, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+	for _, instance := range instances {
+		res := resource{ID: instance.name, Name: notebookName(instance.name)}
+		if reason, ok := r.conf.skipReason(instance.labels, r.targetLabel); ok {
+			w.skip(res, reason)
+			continue
+		}
+
+		// check a instance which was already stopped
+		if instance.state == "STOPPED" || instance.state == "STOPPING" {
+			w.already(res)
+			continue
+		}
+		if instance.state != "ACTIVE" {
+			w.skip(res, "state is "+instance.state)
+			continue
+		}
+
+		if r.conf.DryRun {
+			w.done(res)
+			continue
+		}
+
+		instance := instance
+		w.call(res, func() (func() error, error) {
+			wait, err := r.stop(instance)
+			if err != nil {
+				return nil, errors.New("stopping failed: " + err.Error())
+			}
+			return wait, nil
+		})
+	}
+
+	return w.report(model.Notebook)
+}
+
+func (r *NotebookCall) Start() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	instances, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWorker(r.ctx, r.conf)
+	for _, instance := range instances {
+		res := resource{ID: instance.name, Name: notebookName(instance.name)}
+		if reason, ok := r.conf.skipReason(instance.labels, r.targetLabel); ok {
+			w.skip(res, reason)
+			continue
+		}
+
+		// check a instance which was already running
+		if instance.state == "ACTIVE" || instance.state == "STARTING" || instance.state == "PROVISIONING" {
+			w.already(res)
+			continue
+		}
+		if instance.state != "STOPPED" {
+			w.skip(res, "state is "+instance.state)
+			continue
+		}
+
+		if r.conf.DryRun {
+			w.done(res)
+			continue
+		}
+
+		instance := instance
+		w.call(res, func() (func() error, error) {
+			return r.start(instance)
+		})
+	}
+
+	return w.report(model.Notebook)
+}
+
+// stop stops the instance by the API which listed it, and returns the function which waits for the operation
+func (r *NotebookCall) stop(instance *notebook) (func() error, error) {
+	if instance.v2 {
+		op, err := notebooksv2.NewProjectsLocationsInstancesService(r.v2).Stop(instance.name, &notebooksv2.StopInstanceRequest{}).Context(r.ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return waitNotebookV2(r.ctx, r.conf, r.v2, op), nil
+	}
+	op, err := notebooks.NewProjectsLocationsInstancesService(r.s).Stop(instance.name, &notebooks.StopInstanceRequest{}).Context(r.ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return waitNotebook(r.ctx, r.conf, r.s, op), nil
+}
+
+// start starts the instance by the API which listed it, and returns the function which waits for the operation
+func (r *NotebookCall) start(instance *notebook) (func() error, error) {
+	if instance.v2 {
+		op, err := notebooksv2.NewProjectsLocationsInstancesService(r.v2).Start(instance.name, &notebooksv2.StartInstanceRequest{}).Context(r.ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return waitNotebookV2(r.ctx, r.conf, r.v2, op), nil
+	}
+	op, err := notebooks.NewProjectsLocationsInstancesService(r.s).Start(instance.name, &notebooks.StartInstanceRequest{}).Context(r.ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return waitNotebook(r.ctx, r.conf, r.s, op), nil
+}
+
+// list the labeled instances of the v1 and v2 APIs in all locations.
+// an instance listed by both APIs is changed by the v1 API
+func (r *NotebookCall) list() ([]*notebook, error) {
+	var v1 []*notebook
+	parent := "projects/" + r.projectID + "/locations/-"
+	_, err := r.conf.retry(r.ctx, func() error {
+		v1 = nil
+		return notebooks.NewProjectsLocationsInstancesService(r.s).List(parent).Pages(r.ctx, func(list *notebooks.ListInstancesResponse) error {
+			for _, instance := range list.Instances {
+				v1 = append(v1, &notebook{name: instance.Name, state: instance.State, labels: instance.Labels})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var v2 []*notebook
+	_, err = r.conf.retry(r.ctx, func() error {
+		v2 = nil
+		return notebooksv2.NewProjectsLocationsInstancesService(r.v2).List(parent).Pages(r.ctx, func(list *notebooksv2.ListInstancesResponse) error {
+			for _, instance := range list.Instances {
+				v2 = append(v2, &notebook{name: instance.Name, state: instance.State, labels: instance.Labels, v2: true})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*notebook
+	names := make(map[string]bool)
+	for _, instance := range append(v1, v2...) {
+		if names[instance.name] {
+			continue
+		}
+		names[instance.name] = true
+		if r.targetLabel != "" && instance.labels[r.targetLabel] != r.value {
+			continue
+		}
+		res = append(res, instance)
+	}
+	return res, nil
+}
+
+// instance name without "projects/{project}/locations/{zone}/instances/"
+func notebookName(name string) string {
+	elements := strings.Split(name, "/")
+	return elements[len(elements)-1]
+}
@@ -0,0 +1,303 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	bigtableadmin "google.golang.org/api/bigtableadmin/v2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/container/v1"
+	dataproc "google.golang.org/api/dataproc/v1"
+	notebooks "google.golang.org/api/notebooks/v1"
+	notebooksv2 "google.golang.org/api/notebooks/v2"
+	run "google.golang.org/api/run/v1"
+	spanner "google.golang.org/api/spanner/v1"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// waitZone returns the function which waits for the compute zone operation
+func waitZone(ctx context.Context, conf Config, s *compute.Service, projectID, zone string, op *compute.Operation) func() error {
+	return func() error {
+		return waitZoneOperation(ctx, conf, s, projectID, zone, op)
+	}
+}
+
+// waitRegion returns the function which waits for the compute region operation
+func waitRegion(ctx context.Context, conf Config, s *compute.Service, projectID, region string, op *compute.Operation) func() error {
+	return func() error {
+		return waitRegionOperation(ctx, conf, s, projectID, region, op)
+	}
+}
+
+// waitSQL returns the function which waits for the Cloud SQL operation
+func waitSQL(ctx context.Context, conf Config, s *sqladmin.Service, projectID string, op *sqladmin.Operation) func() error {
+	return func() error {
+		return waitSQLOperation(ctx, conf, s, projectID, op)
+	}
+}
+
+// waitNotebook returns the function which waits for the notebooks operation
+func waitNotebook(ctx context.Context, conf Config, s *notebooks.Service, op *notebooks.Operation) func() error {
+	return func() error {
+		return waitNotebookOperation(ctx, conf, s, op)
+	}
+}
+
+// waitNotebookV2 returns the function which waits for the notebooks v2 operation
+func waitNotebookV2(ctx context.Context, conf Config, s *notebooksv2.Service, op *notebooksv2.Operation) func() error {
+	return func() error {
+		return waitNotebookV2Operation(ctx, conf, s, op)
+	}
+}
+
+// waitSpanner returns the function which waits for the Spanner instance operation
+func waitSpanner(ctx context.Context, conf Config, s *spanner.Service, op *spanner.Operation) func() error {
+	return func() error {
+		return waitSpannerOperation(ctx, conf, s, op)
+	}
+}
+
+// waitBigtable returns the function which waits for the Bigtable operation
+func waitBigtable(ctx context.Context, conf Config, s *bigtableadmin.Service, op *bigtableadmin.Operation) func() error {
+	return func() error {
+		return waitBigtableOperation(ctx, conf, s, op)
+	}
+}
+
+// waitDataproc returns the function which waits for the Dataproc operation
+func waitDataproc(ctx context.Context, conf Config, s *dataproc.Service, op *dataproc.Operation) func() error {
+	return func() error {
+		return waitDataprocOperation(ctx, conf, s, op)
+	}
+}
+
+// waitRun returns the function which waits for the Cloud Run service
+func waitRun(ctx context.Context, conf Config, s *run.APIService, name string, generation int64) func() error {
+	return func() error {
+		return waitRunService(ctx, conf, s, name, generation)
+	}
+}
+
+// poll gets the operation by get every OperationPollInterval until done reports true.
+// done returns the error of the finished operation. get is retried by the retry policies
+func poll(ctx context.Context, conf Config, get func() error, done func() (bool, error)) error {
+	for {
+		if ok, err := done(); ok {
+			return err
+		}
+		if err := sleep(ctx, OperationPollInterval); err != nil {
+			return err
+		}
+		if _, err := conf.retry(ctx, get); err != nil {
+			return err
+		}
+	}
+}
+
+// waitZoneOperation polls the compute zone operation until DONE
+func waitZoneOperation(ctx context.Context, conf Config, s *compute.Service, projectID, zone string, op *compute.Operation) error {
+	name := op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = compute.NewZoneOperationsService(s).Get(projectID, zone, name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		return op.Status == "DONE", computeError(op)
+	})
+}
+
+// waitRegionOperation polls the compute region operation until DONE
+func waitRegionOperation(ctx context.Context, conf Config, s *compute.Service, projectID, region string, op *compute.Operation) error {
+	name := op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = compute.NewRegionOperationsService(s).Get(projectID, region, name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		return op.Status == "DONE", computeError(op)
+	})
+}
+
+// waitSQLOperation polls the Cloud SQL operation until DONE
+func waitSQLOperation(ctx context.Context, conf Config, s *sqladmin.Service, projectID string, op *sqladmin.Operation) error {
+	name := op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = sqladmin.NewOperationsService(s).Get(projectID, name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		if op.Error == nil {
+			return op.Status == "DONE", nil
+		}
+		var messages []string
+		for _, e := range op.Error.Errors {
+			messages = append(messages, e.Code+": "+e.Message)
+		}
+		return op.Status == "DONE", joinErrors(messages)
+	})
+}
+
+// waitContainerOperation polls the GKE operation until DONE
+func waitContainerOperation(ctx context.Context, conf Config, s *container.Service, projectID, location string, op *container.Operation) error {
+	name := "projects/" + projectID + "/locations/" + location + "/operations/" + op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = container.NewProjectsLocationsOperationsService(s).Get(name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		if op.StatusMessage != "" {
+			return op.Status == "DONE", errors.New(op.StatusMessage)
+		}
+		return op.Status == "DONE", nil
+	})
+}
+
+// waitNotebookOperation polls the notebooks operation until done
+func waitNotebookOperation(ctx context.Context, conf Config, s *notebooks.Service, op *notebooks.Operation) error {
+	name := op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = notebooks.NewProjectsLocationsOperationsService(s).Get(name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		if op.Error != nil {
+			return op.Done, errors.New(op.Error.Message)
+		}
+		return op.Done, nil
+	})
+}
+
+// waitNotebookV2Operation polls the notebooks v2 operation until done
+func waitNotebookV2Operation(ctx context.Context, conf Config, s *notebooksv2.Service, op *notebooksv2.Operation) error {
+	name := op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = notebooksv2.NewProjectsLocationsOperationsService(s).Get(name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		if op.Error != nil {
+			return op.Done, errors.New(op.Error.Message)
+		}
+		return op.Done, nil
+	})
+}
+
+// waitSpannerOperation polls the Spanner instance operation until done
+func waitSpannerOperation(ctx context.Context, conf Config, s *spanner.Service, op *spanner.Operation) error {
+	name := op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = spanner.NewProjectsInstancesOperationsService(s).Get(name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		if op.Error != nil {
+			return op.Done, errors.New(op.Error.Message)
+		}
+		return op.Done, nil
+	})
+}
+
+// waitBigtableOperation polls the Bigtable operation until done
+func waitBigtableOperation(ctx context.Context, conf Config, s *bigtableadmin.Service, op *bigtableadmin.Operation) error {
+	name := op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = bigtableadmin.NewOperationsService(s).Get(name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		if op.Error != nil {
+			return op.Done, errors.New(op.Error.Message)
+		}
+		return op.Done, nil
+	})
+}
+
+// waitDataprocOperation polls the Dataproc operation until done
+func waitDataprocOperation(ctx context.Context, conf Config, s *dataproc.Service, op *dataproc.Operation) error {
+	name := op.Name
+	return poll(ctx, conf, func() error {
+		var err error
+		op, err = dataproc.NewProjectsRegionsOperationsService(s).Get(name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		if op.Error != nil {
+			return op.Done, errors.New(op.Error.Message)
+		}
+		return op.Done, nil
+	})
+}
+
+// waitRunService polls the Cloud Run service until the generation is ready
+func waitRunService(ctx context.Context, conf Config, s *run.APIService, name string, generation int64) error {
+	var service *run.Service
+	return poll(ctx, conf, func() error {
+		var err error
+		service, err = run.NewNamespacesServicesService(s).Get(name).Context(ctx).Do()
+		return err
+	}, func() (bool, error) {
+		if service == nil || service.Status == nil || service.Status.ObservedGeneration < generation {
+			return false, nil
+		}
+		for _, c := range service.Status.Conditions {
+			if c.Type != "Ready" {
+				continue
+			}
+			switch c.Status {
+			case "True":
+				return true, nil
+			case "False":
+				return true, errors.New(c.Message)
+			}
+		}
+		return false, nil
+	})
+}
+
+// computeError returns the errors of the compute operation, or nil
+func computeError(op *compute.Operation) error {
+	if op.Error == nil {
+		return nil
+	}
+	var messages []string
+	for _, e := range op.Error.Errors {
+		messages = append(messages, e.Code+": "+e.Message)
+	}
+	return joinErrors(messages)
+}
+
+// joinErrors returns the error of the messages, or nil if no message
+func joinErrors(messages []string) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(messages, ", "))
+}
+
+// sleep returns ctx error if ctx is done before d
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
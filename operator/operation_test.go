@@ -0,0 +1,50 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestPollDone(t *testing.T) {
+	want := errors.New("quota exceeded")
+	err := poll(context.Background(), Config{}, func() error {
+		t.Error("get is called for the finished operation")
+		return nil
+	}, func() (bool, error) {
+		return true, want
+	})
+	if err != want {
+		t.Errorf("poll() = %v, want %v", err, want)
+	}
+}
+
+func TestPollCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := poll(ctx, Config{}, func() error {
+		t.Error("get is called after the context is canceled")
+		return nil
+	}, func() (bool, error) {
+		return false, nil
+	})
+	if err != context.Canceled {
+		t.Errorf("poll() = %v, want %v", err, context.Canceled)
+	}
+}
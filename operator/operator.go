@@ -0,0 +1,164 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/future-architect/gcp-instance-scheduler/model"
+	"golang.org/x/net/context"
+)
+
+// Operator stops and starts one type of gcp resource
+type Operator interface {
+	// Name returns the resource type name. e.g. model.ComputeEngine
+	Name() string
+	// Filter narrows down the target resources by label
+	Filter(labelName, value string) Operator
+	// Stop shutdowns the target resources
+	Stop() (*model.Report, error)
+	// Start launches the target resources
+	Start() (*model.Report, error)
+}
+
+// Factory creates an Operator for the project
+type Factory func(ctx context.Context, projectID string, conf Config) Operator
+
+// Stages of operators. Operators in the same stage are independent and may run in parallel.
+// Stages are stopped in ascending order and started in descending order.
+const (
+	// resources which run the applications. GCE instances managed by instance groups (including GKE nodes)
+	// are changed only by their group, so the operators of this stage never change the same VM
+	StageCompute = iota
+	// databases used by the applications. stopped after and started before them
+	StageDatabase
+)
+
+type entry struct {
+	name    string
+	stage   int
+	factory Factory
+}
+
+// registered operators in shutdown order
+var registry []entry
+
+func init() {
+	Register(model.GKENodePool, StageCompute, func(ctx context.Context, projectID string, conf Config) Operator {
+		return GKENodePool(ctx, projectID, conf)
+	})
+	Register(model.InstanceGroup, StageCompute, func(ctx context.Context, projectID string, conf Config) Operator {
+		return InstanceGroup(ctx, projectID, conf)
+	})
+	Register(model.ComputeEngine, StageCompute, func(ctx context.Context, projectID string, conf Config) Operator {
+		return ComputeEngine(ctx, projectID, conf)
+	})
+	Register(model.Notebook, StageCompute, func(ctx context.Context, projectID string, conf Config) Operator {
+		return Notebook(ctx, projectID, conf)
+	})
+	Register(model.Dataproc, StageCompute, func(ctx context.Context, projectID string, conf Config) Operator {
+		return Dataproc(ctx, projectID, conf)
+	})
+	Register(model.CloudRun, StageCompute, func(ctx context.Context, projectID string, conf Config) Operator {
+		return CloudRun(ctx, projectID, conf)
+	})
+	Register(model.SQL, StageDatabase, func(ctx context.Context, projectID string, conf Config) Operator {
+		return SQL(ctx, projectID, conf)
+	})
+	Register(model.Spanner, StageDatabase, func(ctx context.Context, projectID string, conf Config) Operator {
+		return Spanner(ctx, projectID, conf)
+	})
+	Register(model.Bigtable, StageDatabase, func(ctx context.Context, projectID string, conf Config) Operator {
+		return Bigtable(ctx, projectID, conf)
+	})
+}
+
+// Register adds an operator to the registry.
+// Operators are stopped in stage and registration order, and started in reverse order.
+func Register(name string, stage int, factory Factory) {
+	if factory == nil {
+		panic("operator: Register factory is nil")
+	}
+	for _, e := range registry {
+		if e.name == name {
+			panic("operator: Register called twice for " + name)
+		}
+	}
+
+	// insert after the operators of the same or earlier stages
+	i := len(registry)
+	for i > 0 && registry[i-1].stage > stage {
+		i--
+	}
+	registry = append(registry, entry{})
+	copy(registry[i+1:], registry[i:])
+	registry[i] = entry{name: name, stage: stage, factory: factory}
+}
+
+// Names returns all registered operator names in registration order
+func Names() []string {
+	var res []string
+	for _, e := range registry {
+		res = append(res, e.name)
+	}
+	return res
+}
+
+// Select returns the factories of the operators which are enabled in this run, grouped by stage in shutdown order.
+// All registered operators are enabled when targets is empty.
+func Select(targets, excludes []string) ([][]Factory, error) {
+	for _, name := range append(append([]string{}, targets...), excludes...) {
+		if !registered(name) {
+			return nil, fmt.Errorf("unknown operator: %v (available: %v)", name, strings.Join(Names(), ", "))
+		}
+	}
+
+	var res [][]Factory
+	stage := -1
+	for _, e := range registry {
+		if len(targets) > 0 && !contains(targets, e.name) {
+			continue
+		}
+		if contains(excludes, e.name) {
+			continue
+		}
+		if len(res) == 0 || e.stage != stage {
+			res = append(res, nil)
+			stage = e.stage
+		}
+		res[len(res)-1] = append(res[len(res)-1], e.factory)
+	}
+	return res, nil
+}
+
+func registered(name string) bool {
+	for _, e := range registry {
+		if e.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
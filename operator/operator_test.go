@@ -0,0 +1,123 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/future-architect/gcp-instance-scheduler/model"
+	"golang.org/x/net/context"
+)
+
+type namedOperator string
+
+func (o namedOperator) Name() string {
+	return string(o)
+}
+
+func (o namedOperator) Filter(labelName, value string) Operator {
+	return o
+}
+
+func (o namedOperator) Stop() (*model.Report, error) {
+	return &model.Report{InstanceType: string(o)}, nil
+}
+
+func (o namedOperator) Start() (*model.Report, error) {
+	return &model.Report{InstanceType: string(o)}, nil
+}
+
+// withRegistry replaces the registry with the operators of the names and stages in registration order
+func withRegistry(t *testing.T, entries ...interface{}) {
+	saved := registry
+	t.Cleanup(func() { registry = saved })
+	registry = nil
+	for i := 0; i < len(entries); i += 2 {
+		name := entries[i].(string)
+		Register(name, entries[i+1].(int), func(ctx context.Context, projectID string, conf Config) Operator {
+			return namedOperator(name)
+		})
+	}
+}
+
+// names of the selected factories per stage
+func stageNames(stages [][]Factory) [][]string {
+	var res [][]string
+	for _, stage := range stages {
+		var names []string
+		for _, f := range stage {
+			names = append(names, f(context.Background(), "", Config{}).Name())
+		}
+		res = append(res, names)
+	}
+	return res
+}
+
+func TestRegisterOrder(t *testing.T) {
+	withRegistry(t, "sql", StageDatabase, "gke", StageCompute, "spanner", StageDatabase, "gce", StageCompute)
+
+	want := []string{"gke", "gce", "sql", "spanner"}
+	if got := Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	withRegistry(t, "gce", StageCompute)
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() does not panic for the same name")
+		}
+	}()
+	Register("gce", StageCompute, func(ctx context.Context, projectID string, conf Config) Operator {
+		return namedOperator("gce")
+	})
+}
+
+func TestSelect(t *testing.T) {
+	withRegistry(t, "gke", StageCompute, "gce", StageCompute, "sql", StageDatabase, "spanner", StageDatabase)
+
+	tests := []struct {
+		name     string
+		targets  []string
+		excludes []string
+		want     [][]string
+	}{
+		{"all", nil, nil, [][]string{{"gke", "gce"}, {"sql", "spanner"}}},
+		{"targets", []string{"spanner", "gce"}, nil, [][]string{{"gce"}, {"spanner"}}},
+		{"excludes", nil, []string{"gke", "sql", "spanner"}, [][]string{{"gce"}}},
+		{"targets and excludes", []string{"gce", "sql"}, []string{"gce"}, [][]string{{"sql"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stages, err := Select(tt.targets, tt.excludes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stageNames(stages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Select() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Select([]string{"unknown"}, nil); err == nil {
+		t.Error("Select() accepts an unknown target")
+	}
+	if _, err := Select(nil, []string{"unknown"}); err == nil {
+		t.Error("Select() accepts an unknown exclude")
+	}
+}
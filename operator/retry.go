@@ -0,0 +1,155 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// Error classes of the transient GCP API errors
+const (
+	// 429 and rateLimitExceeded
+	ErrorRateLimit = "rateLimit"
+	// 500, 502, 503 and 504
+	ErrorUnavailable = "unavailable"
+	// resourceNotReady. e.g. the instance is in transition
+	ErrorNotReady = "notReady"
+	// 409. e.g. another Cloud SQL operation is in progress
+	ErrorConflict = "conflict"
+)
+
+// RetryPolicy is the exponential backoff settings of an error class
+type RetryPolicy struct {
+	MaxRetries      int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+}
+
+// Retry is the retry policies per error class. The errors of the other classes are not retried.
+type Retry map[string]RetryPolicy
+
+// DefaultRetry returns the default retry policies
+func DefaultRetry() Retry {
+	return Retry{
+		ErrorRateLimit:   {MaxRetries: 5, InitialInterval: time.Second, MaxInterval: 30 * time.Second, Multiplier: 2},
+		ErrorUnavailable: {MaxRetries: 3, InitialInterval: time.Second, MaxInterval: 10 * time.Second, Multiplier: 2},
+		ErrorNotReady:    {MaxRetries: 5, InitialInterval: 2 * time.Second, MaxInterval: 30 * time.Second, Multiplier: 2},
+		ErrorConflict:    {MaxRetries: 5, InitialInterval: 5 * time.Second, MaxInterval: 60 * time.Second, Multiplier: 2},
+	}
+}
+
+// WithMaxRetries returns the copy of the policies which max retries are overwritten.
+// key is the error class
+func (r Retry) WithMaxRetries(maxRetries map[string]int) (Retry, error) {
+	res := make(Retry)
+	for class, p := range r {
+		res[class] = p
+	}
+	for class, n := range maxRetries {
+		p, ok := res[class]
+		if !ok {
+			return nil, fmt.Errorf("unknown error class: %v", class)
+		}
+		p.MaxRetries = n
+		res[class] = p
+	}
+	return res, nil
+}
+
+// interval returns the backoff before the n-th retry (0 origin)
+func (p RetryPolicy) interval(n int) time.Duration {
+	d := float64(p.InitialInterval)
+	for i := 0; i < n; i++ {
+		d *= p.Multiplier
+		if d > float64(p.MaxInterval) {
+			return p.MaxInterval
+		}
+	}
+	return time.Duration(d)
+}
+
+// retry calls f until it succeeds or the error is not retryable by the policies.
+// It returns the number of the retries
+func (c Config) retry(ctx context.Context, f func() error) (int, error) {
+	for n := 0; ; n++ {
+		err := f()
+		if err == nil {
+			return n, nil
+		}
+
+		p, ok := c.Retry[classify(err)]
+		if !ok || n >= p.MaxRetries {
+			return n, err
+		}
+		if sleep(ctx, p.interval(n)) != nil {
+			return n, err
+		}
+	}
+}
+
+// conflicted reports whether the update failed because the resource was changed after listing.
+// it is not retried because the request has the stale version
+func conflicted(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if e.Code == http.StatusPreconditionFailed {
+		return true
+	}
+	for _, item := range e.Errors {
+		if item.Reason == "staleData" || item.Reason == "conditionNotMet" {
+			return true
+		}
+	}
+	// the Knative style APIs (e.g. Cloud Run) reject the stale resourceVersion by 409 with this message
+	return e.Code == http.StatusConflict && strings.Contains(e.Message, "was specified but current version is")
+}
+
+// classify returns the error class, or empty if the error is not transient.
+// the conflicted request is not retried even if it is 409, because it would be rejected again
+func classify(err error) string {
+	e, ok := err.(*googleapi.Error)
+	if !ok || conflicted(err) {
+		return ""
+	}
+
+	for _, item := range e.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			return ErrorRateLimit
+		case "resourceNotReady":
+			return ErrorNotReady
+		}
+	}
+
+	switch e.Code {
+	case http.StatusTooManyRequests:
+		return ErrorRateLimit
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrorUnavailable
+	case http.StatusConflict:
+		return ErrorConflict
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryPolicyInterval(t *testing.T) {
+	p := RetryPolicy{InitialInterval: time.Second, MaxInterval: 10 * time.Second, Multiplier: 2}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for n, w := range want {
+		if got := p.interval(n); got != w {
+			t.Errorf("interval(%d) = %v, want %v", n, got, w)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"429", &googleapi.Error{Code: http.StatusTooManyRequests}, ErrorRateLimit},
+		{"rateLimitExceeded", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, ErrorRateLimit},
+		{"userRateLimitExceeded", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, ErrorRateLimit},
+		{"503", &googleapi.Error{Code: http.StatusServiceUnavailable}, ErrorUnavailable},
+		{"500", &googleapi.Error{Code: http.StatusInternalServerError}, ErrorUnavailable},
+		{"resourceNotReady", &googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "resourceNotReady"}}}, ErrorNotReady},
+		{"409", &googleapi.Error{Code: http.StatusConflict}, ErrorConflict},
+		{"409 staleData", &googleapi.Error{Code: http.StatusConflict, Errors: []googleapi.ErrorItem{{Reason: "staleData"}}}, ""},
+		{"409 stale resourceVersion", &googleapi.Error{Code: http.StatusConflict, Message: "Conflict for resource 'web': version '12' was specified but current version is '13'."}, ""},
+		{"412", &googleapi.Error{Code: http.StatusPreconditionFailed}, ""},
+		{"403", &googleapi.Error{Code: http.StatusForbidden}, ""},
+		{"404", &googleapi.Error{Code: http.StatusNotFound}, ""},
+		{"not api error", errors.New("broken"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classify(tt.err); got != tt.want {
+				t.Errorf("classify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithMaxRetries(t *testing.T) {
+	r, err := DefaultRetry().WithMaxRetries(map[string]int{ErrorRateLimit: 10, ErrorConflict: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r[ErrorRateLimit].MaxRetries != 10 || r[ErrorConflict].MaxRetries != 0 {
+		t.Errorf("max retries are not overwritten: %v", r)
+	}
+	if DefaultRetry()[ErrorRateLimit].MaxRetries != 5 {
+		t.Error("default retry is changed")
+	}
+	if _, err := DefaultRetry().WithMaxRetries(map[string]int{"unknown": 1}); err == nil {
+		t.Error("unknown error class is accepted")
+	}
+}
+
+func TestConfigRetry(t *testing.T) {
+	fast := RetryPolicy{MaxRetries: 2, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 2}
+	conf := Config{Retry: Retry{ErrorUnavailable: fast}}
+
+	calls := 0
+	n, err := conf.retry(context.Background(), func() error {
+		calls++
+		if calls < 2 {
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	if err != nil || n != 1 || calls != 2 {
+		t.Errorf("retry() = %v, %v with %v calls, want 1, nil with 2 calls", n, err, calls)
+	}
+
+	calls = 0
+	n, err = conf.retry(context.Background(), func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	if err == nil || n != 2 || calls != 3 {
+		t.Errorf("retry() = %v, %v with %v calls, want 2, error with 3 calls", n, err, calls)
+	}
+
+	// not configured class
+	calls = 0
+	_, err = conf.retry(context.Background(), func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusTooManyRequests}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("retry() = %v with %v calls, want error with 1 call", err, calls)
+	}
+}
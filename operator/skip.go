@@ -0,0 +1,65 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"time"
+)
+
+// SkipLabelSuffix is the suffix of the protection label name.
+// The resource is not stopped or started until the time of the label value.
+// e.g. state-scheduler-skip-until: 2026-10-20t18-00
+const SkipLabelSuffix = "-skip-until"
+
+// label values can not contain ":" and upper case letters
+var skipUntilFormats = []string{"2006-01-02t15-04", "2006-01-02_15-04"}
+
+// skipReason returns the reason if the resource is protected by the label now
+func (c Config) skipReason(labels map[string]string, labelName string) (string, bool) {
+	name := labelName + SkipLabelSuffix
+	v, ok := labels[name]
+	if !ok {
+		return "", false
+	}
+
+	until, err := c.parseSkipUntil(v)
+	if err != nil {
+		// protect the resource rather than ignoring the owner's intention
+		return "invalid " + name + " label: " + v, true
+	}
+	if !time.Now().Before(until) {
+		return "", false
+	}
+	return "skip until " + until.Format("2006-01-02 15:04 MST"), true
+}
+
+// parse "yyyy-mm-ddthh-mm" or "yyyy-mm-dd" (until the end of the day)
+func (c Config) parseSkipUntil(v string) (time.Time, error) {
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, f := range skipUntilFormats {
+		if t, err := time.ParseInLocation(f, v, loc); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, loc)
+	if err != nil {
+		return t, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
@@ -0,0 +1,227 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/future-architect/gcp-instance-scheduler/model"
+	"golang.org/x/net/context"
+	spanner "google.golang.org/api/spanner/v1"
+)
+
+// default processing units of the Spanner instances at shutdown. the minimum size of an instance
+const DefaultSpannerProcessingUnits = 100
+
+// SpannerCall scales down the Spanner instances at shutdown, because they can't be stopped
+type SpannerCall struct {
+	s           *spanner.Service
+	call        *spanner.ProjectsInstancesListCall
+	targetLabel string
+	value       string
+	projectID   string
+	conf        Config
+	error       error
+	ctx         context.Context
+}
+
+func Spanner(ctx context.Context, projectID string, conf Config) *SpannerCall {
+	s, err := spanner.NewService(ctx)
+	if err != nil {
+		return &SpannerCall{error: err}
+	}
+
+	return &SpannerCall{
+		s:         s,
+		projectID: projectID,
+		conf:      conf,
+		ctx:       ctx,
+		call:      spanner.NewProjectsInstancesService(s).List("projects/" + projectID),
+	}
+}
+
+func (r *SpannerCall) Name() string {
+	return model.Spanner
+}
+
+// Filter narrows down the instances by the list API, and by the exact value after listing
+// because the filter of the list API matches the label value partially
+func (r *SpannerCall) Filter(labelName, value string) Operator {
+	if r.error != nil {
+		return r
+	}
+	r.targetLabel = labelName
+	r.value = value
+	r.call = r.call.Filter("labels." + labelName + ":" + value)
+	return r
+}
+
+// Stop saves the processing units of the target instances and scales them down to Config.SpannerProcessingUnits
+func (r *SpannerCall) Stop() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	instances, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	minimum := r.conf.spannerProcessingUnits()
+	w := newWorker(r.ctx, r.conf)
+	for _, instance := range instances {
+		res := resource{ID: instance.Name, Name: spannerName(instance)}
+		if reason, ok := r.conf.skipReason(instance.Labels, r.targetLabel); ok {
+			w.skip(res, reason)
+			continue
+		}
+		if instance.State != "READY" {
+			w.skip(res, "state is "+instance.State)
+			continue
+		}
+
+		// the size was saved by the last shutdown if it is already scaled down
+		if instance.ProcessingUnits <= minimum {
+			w.already(res)
+			continue
+		}
+
+		if r.conf.DryRun {
+			w.done(res)
+			continue
+		}
+
+		path := instance.Name
+		saving := &Size{ProcessingUnits: instance.ProcessingUnits}
+		w.call(res, func() (func() error, error) {
+			if err := r.conf.putState(r.ctx, spannerKey(path), saving); err != nil {
+				return nil, errors.New("saving size failed: " + err.Error())
+			}
+			return r.scale(path, minimum)
+		})
+	}
+
+	return w.report(model.Spanner)
+}
+
+// Start restores the processing units saved at shutdown
+func (r *SpannerCall) Start() (*model.Report, error) {
+	if r.error != nil {
+		return nil, r.error
+	}
+
+	instances, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+
+	minimum := r.conf.spannerProcessingUnits()
+	w := newWorker(r.ctx, r.conf)
+	for _, instance := range instances {
+		res := resource{ID: instance.Name, Name: spannerName(instance)}
+		if reason, ok := r.conf.skipReason(instance.Labels, r.targetLabel); ok {
+			w.skip(res, reason)
+			continue
+		}
+		if instance.State != "READY" {
+			w.skip(res, "state is "+instance.State)
+			continue
+		}
+
+		saved, err := r.conf.getState(r.ctx, spannerKey(instance.Name))
+		if err != nil {
+			w.fail(res, err)
+			continue
+		}
+		if saved == nil || saved.ProcessingUnits == 0 {
+			if instance.ProcessingUnits <= minimum {
+				w.skip(res, "size at shutdown is unknown")
+			} else {
+				w.already(res)
+			}
+			continue
+		}
+		w.forget(res, spannerKey(instance.Name))
+		if instance.ProcessingUnits >= saved.ProcessingUnits {
+			w.already(res)
+			continue
+		}
+
+		if r.conf.DryRun {
+			w.done(res)
+			continue
+		}
+
+		path := instance.Name
+		units := saved.ProcessingUnits
+		w.call(res, func() (func() error, error) {
+			return r.scale(path, units)
+		})
+	}
+
+	return w.report(model.Spanner)
+}
+
+// scale updates only the processing units of the instance
+func (r *SpannerCall) scale(path string, units int64) (func() error, error) {
+	req := &spanner.UpdateInstanceRequest{
+		Instance:  &spanner.Instance{ProcessingUnits: units},
+		FieldMask: "processingUnits",
+	}
+	op, err := spanner.NewProjectsInstancesService(r.s).Patch(path, req).Context(r.ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return waitSpanner(r.ctx, r.conf, r.s, op), nil
+}
+
+// list the target instances of all pages
+func (r *SpannerCall) list() ([]*spanner.Instance, error) {
+	var res []*spanner.Instance
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = nil
+		return r.call.Pages(r.ctx, func(list *spanner.ListInstancesResponse) error {
+			for _, instance := range list.Instances {
+				if r.targetLabel != "" && instance.Labels[r.targetLabel] != r.value {
+					continue
+				}
+				res = append(res, instance)
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (c Config) spannerProcessingUnits() int64 {
+	if c.SpannerProcessingUnits <= 0 {
+		return DefaultSpannerProcessingUnits
+	}
+	return c.SpannerProcessingUnits
+}
+
+// spannerKey returns the key of the Spanner instance in the state store.
+// the service name is added not to collide with the Cloud SQL instance of the same name
+func spannerKey(path string) string {
+	return "spanner.googleapis.com/" + path
+}
+
+// instance name without "projects/{project}/instances/"
+func spannerName(instance *spanner.Instance) string {
+	elements := strings.Split(instance.Name, "/")
+	return elements[len(elements)-1]
+}
@@ -16,23 +16,25 @@
 package operator
 
 import (
-	"time"
+	"strings"
 
 	"github.com/future-architect/gcp-instance-scheduler/model"
 
-	"github.com/hashicorp/go-multierror"
 	"golang.org/x/net/context"
 	sqladmin "google.golang.org/api/sqladmin/v1beta4"
 )
 
 type SQLCall struct {
-	s         *sqladmin.Service
-	call      *sqladmin.InstancesListCall
-	projectID string
-	error     error
+	s           *sqladmin.Service
+	call        *sqladmin.InstancesListCall
+	targetLabel string
+	projectID   string
+	conf        Config
+	error       error
+	ctx         context.Context
 }
 
-func SQL(ctx context.Context, projectID string) *SQLCall {
+func SQL(ctx context.Context, projectID string, conf Config) *SQLCall {
 	s, err := sqladmin.NewService(ctx)
 	if err != nil {
 		return &SQLCall{error: err}
@@ -41,11 +43,17 @@ func SQL(ctx context.Context, projectID string) *SQLCall {
 	return &SQLCall{
 		s:         s,
 		projectID: projectID,
+		conf:      conf,
+		ctx:       ctx,
 		call:      sqladmin.NewInstancesService(s).List(projectID),
 	}
 }
 
-func (r *SQLCall) Filter(labelName, value string) *SQLCall {
+func (r *SQLCall) Name() string {
+	return model.SQL
+}
+
+func (r *SQLCall) Filter(labelName, value string) Operator {
 	if r.error != nil {
 		return r
 	}
@@ -55,96 +63,241 @@ func (r *SQLCall) Filter(labelName, value string) *SQLCall {
 	// curl --header "Authorization: Bearer ${ACCESS_TOKEN}" \
 	//     -X GET \
 	//     https://www.googleapis.com/sql/v1beta4/projects/[PROJECT_ID]/instances/list?filter=userLabels.[KEY1_NAME]:[KEY1_VALUE]%20userLabels.[KEY2_NAME]:[KEY2_VALUE]
+	r.targetLabel = labelName
 	r.call = r.call.Filter("settings.userLabels." + labelName + "=" + value)
 	return r
 }
 
+// Stop sets the activation policy of the target instances to NEVER.
+// the read replicas are stopped before the primaries, because a primary which has running replicas can't be stopped
 func (r *SQLCall) Stop() (*model.Report, error) {
 	if r.error != nil {
 		return nil, r.error
 	}
 
-	targets, err := r.call.Do()
+	targets, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+	all, err := r.listAll()
 	if err != nil {
 		return nil, err
 	}
 
-	var res = r.error
-	var doneRes []string
-	var alreadyRes []string
+	w := newWorker(r.ctx, r.conf)
+	primaries, replicas := r.topology(w, targets)
 
-	for _, instance := range targets.Items {
-		// do not change replica instance's activation policy
-		if instance.InstanceType == "READ_REPLICA_INSTANCE" {
-			continue
-		}
+	// stop the replicas and wait for them
+	for _, instance := range replicas {
+		r.stop(w, instance, true)
+	}
+	w.sync()
 
-		// do not change instance's activation policy which is already "NEVER"
-		if instance.Settings.ActivationPolicy == "NEVER" {
-			alreadyRes = append(alreadyRes, instance.Name)
-			continue
+	for _, instance := range primaries {
+		var running []string
+		for _, name := range instance.ReplicaNames {
+			replica, ok := all[name]
+			if !ok || failoverReplica(replica) || replica.Settings.ActivationPolicy == "NEVER" || w.succeeded(named(name)) {
+				continue
+			}
+			running = append(running, name)
 		}
-
-		// update policy
-		instance.Settings.ActivationPolicy = "NEVER"
-
-		// apply the settings
-		_, err := sqladmin.NewInstancesService(r.s).Patch(r.projectID, instance.Name, instance).Do()
-		if err != nil {
-			res = multierror.Append(res, err)
+		if len(running) > 0 && instance.Settings.ActivationPolicy != "NEVER" {
+			w.skip(named(instance.Name), "replicas are running: "+strings.Join(running, ", "))
+			continue
 		}
-		doneRes = append(doneRes, instance.Name)
-		time.Sleep(CallInterval)
+		r.stop(w, instance, false)
 	}
 
-	return &model.Report{
-		InstanceType: model.SQL,
-		Dones:        doneRes,
-		Alreadies:    alreadyRes,
-	}, res
+	return w.report(model.SQL)
 }
 
+// Start sets the activation policy of the target instances to the policy saved at shutdown (default ALWAYS).
+// the primaries are started before the read replicas, because a replica can't run without its primary
 func (r *SQLCall) Start() (*model.Report, error) {
 	if r.error != nil {
 		return nil, r.error
 	}
 
-	targets, err := r.call.Do()
+	targets, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+	all, err := r.listAll()
 	if err != nil {
 		return nil, err
 	}
 
-	var res = r.error
-	var doneRes []string
-	var alreadyRes []string
+	w := newWorker(r.ctx, r.conf)
+	primaries, replicas := r.topology(w, targets)
+
+	// start the primaries and wait for them
+	for _, instance := range primaries {
+		r.start(w, instance, true)
+	}
+	w.sync()
 
-	for _, instance := range targets.Items {
-		// do not change replica instance's activation policy
-		if instance.InstanceType == "READ_REPLICA_INSTANCE" {
+	for _, instance := range replicas {
+		// e.g. "project:primary-name"
+		elements := strings.Split(instance.MasterInstanceName, ":")
+		name := elements[len(elements)-1]
+		if primary, ok := all[name]; ok && primary.Settings.ActivationPolicy == "NEVER" && !w.succeeded(named(name)) {
+			w.skip(named(instance.Name), "primary is not running: "+name)
 			continue
 		}
+		r.start(w, instance, false)
+	}
+
+	return w.report(model.SQL)
+}
 
-		// do not change instance's activation policy which is already "ALWAYS"
-		if instance.Settings.ActivationPolicy == "ALWAYS" {
-			alreadyRes = append(alreadyRes, instance.Name)
+// topology returns the target primaries and read replicas which can be stopped.
+// the protected instances and the instances which can't be stopped are skipped with the reason
+func (r *SQLCall) topology(w *worker, targets []*sqladmin.DatabaseInstance) (primaries, replicas []*sqladmin.DatabaseInstance) {
+	for _, instance := range targets {
+		if reason, ok := r.conf.skipReason(instance.Settings.UserLabels, r.targetLabel); ok {
+			w.skip(named(instance.Name), reason)
 			continue
 		}
 
-		// Update policy
-		instance.Settings.ActivationPolicy = "ALWAYS"
+		switch {
+		case instance.InstanceType == "ON_PREMISES_INSTANCE":
+			w.skip(named(instance.Name), "external primary can't be stopped")
+		case failoverReplica(instance):
+			w.skip(named(instance.Name), "failover replica follows its primary")
+		case instance.InstanceType == "READ_REPLICA_INSTANCE":
+			replicas = append(replicas, instance)
+		default:
+			primaries = append(primaries, instance)
+		}
+	}
+	return primaries, replicas
+}
+
+// stop saves the activation policy of the instance and sets it to NEVER
+func (r *SQLCall) stop(w *worker, instance *sqladmin.DatabaseInstance, sync bool) {
+	// do not change instance's activation policy which is already "NEVER"
+	if instance.Settings.ActivationPolicy == "NEVER" {
+		w.already(named(instance.Name))
+		return
+	}
+
+	if r.conf.DryRun {
+		w.done(named(instance.Name))
+		return
+	}
+
+	saving := &Size{ActivationPolicy: instance.Settings.ActivationPolicy}
+	patch := activationPatch(instance, "NEVER")
 
+	f := func() (func() error, error) {
+		if err := r.conf.putState(r.ctx, sqlKey(r.projectID, instance.Name), saving); err != nil {
+			return nil, err
+		}
 		// apply the settings
-		_, err := sqladmin.NewInstancesService(r.s).Patch(r.projectID, instance.Name, instance).Do()
+		op, err := sqladmin.NewInstancesService(r.s).Patch(r.projectID, instance.Name, patch).Context(r.ctx).Do()
 		if err != nil {
-			res = multierror.Append(res, err)
+			return nil, err
 		}
-		doneRes = append(doneRes, instance.Name)
-		time.Sleep(CallInterval)
+		return waitSQL(r.ctx, r.conf, r.s, r.projectID, op), nil
+	}
+	if sync {
+		w.callSync(named(instance.Name), f)
+	} else {
+		w.call(named(instance.Name), f)
+	}
+}
+
+// start sets the activation policy of the instance to the saved one.
+// ON_DEMAND of the first generation instances is kept as running
+func (r *SQLCall) start(w *worker, instance *sqladmin.DatabaseInstance, sync bool) {
+	// do not change instance's activation policy which is already running
+	if policy := instance.Settings.ActivationPolicy; policy == "ALWAYS" || policy == "ON_DEMAND" {
+		w.already(named(instance.Name))
+		return
+	}
+
+	saved, err := r.conf.getState(r.ctx, sqlKey(r.projectID, instance.Name))
+	if err != nil {
+		w.fail(named(instance.Name), err)
+		return
 	}
+	if saved != nil {
+		w.forget(named(instance.Name), sqlKey(r.projectID, instance.Name))
+	}
+	policy := "ALWAYS"
+	if saved != nil && saved.ActivationPolicy != "" && saved.ActivationPolicy != "NEVER" {
+		policy = saved.ActivationPolicy
+	}
+
+	if r.conf.DryRun {
+		w.done(named(instance.Name))
+		return
+	}
+
+	patch := activationPatch(instance, policy)
+
+	f := func() (func() error, error) {
+		// apply the settings
+		op, err := sqladmin.NewInstancesService(r.s).Patch(r.projectID, instance.Name, patch).Context(r.ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return waitSQL(r.ctx, r.conf, r.s, r.projectID, op), nil
+	}
+	if sync {
+		w.callSync(named(instance.Name), f)
+	} else {
+		w.call(named(instance.Name), f)
+	}
+}
+
+// activationPatch returns the patch which changes only the activation policy.
+// settingsVersion makes the patch fail if the settings are changed by others after listing
+func activationPatch(instance *sqladmin.DatabaseInstance, policy string) *sqladmin.DatabaseInstance {
+	return &sqladmin.DatabaseInstance{
+		Settings: &sqladmin.Settings{
+			ActivationPolicy: policy,
+			SettingsVersion:  instance.Settings.SettingsVersion,
+		},
+	}
+}
+
+// failoverReplica reports whether the instance is the failover replica of the legacy high availability configuration
+func failoverReplica(instance *sqladmin.DatabaseInstance) bool {
+	return instance.InstanceType == "READ_REPLICA_INSTANCE" &&
+		instance.ReplicaConfiguration != nil && instance.ReplicaConfiguration.FailoverTarget
+}
+
+// sqlKey returns the key of the Cloud SQL instance in the state store
+func sqlKey(projectID, name string) string {
+	return "projects/" + projectID + "/instances/" + name
+}
+
+// list the target instances of all pages
+func (r *SQLCall) list() ([]*sqladmin.DatabaseInstance, error) {
+	var res []*sqladmin.DatabaseInstance
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = nil
+		return r.call.Pages(r.ctx, func(list *sqladmin.InstancesListResponse) error {
+			res = append(res, list.Items...)
+			return nil
+		})
+	})
+	return res, err
+}
 
-	return &model.Report{
-		InstanceType: model.SQL,
-		Dones:        doneRes,
-		Alreadies:    alreadyRes,
-	}, res
+// listAll returns map that key=instance name and value=instance of all instances in the project
+func (r *SQLCall) listAll() (map[string]*sqladmin.DatabaseInstance, error) {
+	var res map[string]*sqladmin.DatabaseInstance
+	_, err := r.conf.retry(r.ctx, func() error {
+		res = make(map[string]*sqladmin.DatabaseInstance)
+		return sqladmin.NewInstancesService(r.s).List(r.projectID).Pages(r.ctx, func(list *sqladmin.InstancesListResponse) error {
+			for _, instance := range list.Items {
+				res[instance.Name] = instance
+			}
+			return nil
+		})
+	})
+	return res, err
 }
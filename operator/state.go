@@ -0,0 +1,306 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+// DefaultStateStore is the local JSON file used if no state store is designated
+const DefaultStateStore = "state-scheduler.json"
+
+// Size is the size (or the running settings) of a resource captured at shutdown
+type Size struct {
+	TargetSize int64 `json:"targetSize"`
+	// activation policy of a Cloud SQL instance
+	ActivationPolicy string `json:"activationPolicy,omitempty"`
+	// processing units of a Spanner instance
+	ProcessingUnits int64 `json:"processingUnits,omitempty"`
+	// min instances of a Cloud Run service
+	MinInstances int64 `json:"minInstances,omitempty"`
+	// copies of the revisions pinned in the traffic of a Cloud Run service. key=revision, value=copy
+	Revisions map[string]string `json:"revisions,omitempty"`
+	// autoscaler attached to the group at shutdown. nil if no autoscaler
+	Autoscaler *AutoscalerSize `json:"autoscaler,omitempty"`
+}
+
+// AutoscalerSize is the autoscaler settings at shutdown
+type AutoscalerSize struct {
+	Name string `json:"name"`
+	// mode of an instance group autoscaler. e.g. "ON"
+	Mode string `json:"mode,omitempty"`
+	// min/max node count of a GKE node pool or a Bigtable cluster
+	MinReplicas int64 `json:"minReplicas"`
+	MaxReplicas int64 `json:"maxReplicas"`
+	// target CPU utilization and storage utilization (GiB per node) of a Bigtable cluster
+	CPUUtilization     int64 `json:"cpuUtilization,omitempty"`
+	StorageUtilization int64 `json:"storageUtilization,omitempty"`
+}
+
+// StateStore saves the resource sizes at shutdown to restore exactly them at restart
+type StateStore interface {
+	// Get returns the saved size of the resource, or nil if not saved
+	Get(ctx context.Context, key string) (*Size, error)
+	// Put saves the size of the resource
+	Put(ctx context.Context, key string, size *Size) error
+	// Delete removes the size of the restored resource. it is not an error if the size is not saved
+	Delete(ctx context.Context, key string) error
+}
+
+// NewStateStore returns the state store of the location.
+// "gs://{bucket}/{object}" is a GCS object, "firestore://{project}/{collection}" is the Firestore documents
+// in the default database, and the others are a local JSON file path (optionally prefixed with "file://")
+func NewStateStore(ctx context.Context, location string) (StateStore, error) {
+	switch {
+	case strings.HasPrefix(location, "gs://"):
+		return newGCSStore(ctx, strings.TrimPrefix(location, "gs://"))
+	case strings.HasPrefix(location, "firestore://"):
+		return newFirestoreStore(ctx, strings.TrimPrefix(location, "firestore://"))
+	default:
+		return newFileStore(strings.TrimPrefix(location, "file://")), nil
+	}
+}
+
+// stateKey returns the key of the zonal managed instance group
+func stateKey(projectID, zone, name string) string {
+	return "projects/" + projectID + "/zones/" + zone + "/instanceGroupManagers/" + name
+}
+
+// regionStateKey returns the key of the regional managed instance group
+func regionStateKey(projectID, region, name string) string {
+	return "projects/" + projectID + "/regions/" + region + "/instanceGroupManagers/" + name
+}
+
+// putState saves the size of the resource to the state store
+func (c Config) putState(ctx context.Context, key string, size *Size) error {
+	if c.State == nil {
+		return errors.New("no state store is configured")
+	}
+	return c.State.Put(ctx, key, size)
+}
+
+// getState returns the size of the resource saved in the state store, or nil if not saved
+func (c Config) getState(ctx context.Context, key string) (*Size, error) {
+	if c.State == nil {
+		return nil, errors.New("no state store is configured")
+	}
+	var size *Size
+	_, err := c.retry(ctx, func() error {
+		var err error
+		size, err = c.State.Get(ctx, key)
+		return err
+	})
+	return size, err
+}
+
+// jsonStore keeps all sizes in a JSON object. key=resource key, value=size
+type jsonStore struct {
+	mu    sync.Mutex
+	sizes map[string]*Size
+	read  func(ctx context.Context) ([]byte, error)
+	write func(ctx context.Context, b []byte) error
+}
+
+func (s *jsonStore) Get(ctx context.Context, key string) (*Size, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(ctx); err != nil {
+		return nil, err
+	}
+	return s.sizes[key], nil
+}
+
+func (s *jsonStore) Put(ctx context.Context, key string, size *Size) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(ctx); err != nil {
+		return err
+	}
+	s.sizes[key] = size
+	return s.save(ctx)
+}
+
+func (s *jsonStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(ctx); err != nil {
+		return err
+	}
+	if _, ok := s.sizes[key]; !ok {
+		return nil
+	}
+	delete(s.sizes, key)
+	return s.save(ctx)
+}
+
+// save writes all sizes as the JSON object
+func (s *jsonStore) save(ctx context.Context) error {
+	b, err := json.MarshalIndent(s.sizes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, b)
+}
+
+// load reads the JSON object at first. nil means no object yet
+func (s *jsonStore) load(ctx context.Context) error {
+	if s.sizes != nil {
+		return nil
+	}
+	b, err := s.read(ctx)
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]*Size)
+	if b != nil {
+		if err := json.Unmarshal(b, &sizes); err != nil {
+			return err
+		}
+	}
+	s.sizes = sizes
+	return nil
+}
+
+func newFileStore(path string) StateStore {
+	return &jsonStore{
+		read: func(ctx context.Context) ([]byte, error) {
+			b, err := ioutil.ReadFile(path)
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return b, err
+		},
+		write: func(ctx context.Context, b []byte) error {
+			return ioutil.WriteFile(path, b, 0644)
+		},
+	}
+}
+
+// path is "{bucket}/{object}"
+func newGCSStore(ctx context.Context, path string) (StateStore, error) {
+	i := strings.Index(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		return nil, errors.New("invalid state store: gs://" + path + ": expected gs://{bucket}/{object}")
+	}
+	bucket, object := path[:i], path[i+1:]
+
+	s, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonStore{
+		read: func(ctx context.Context) ([]byte, error) {
+			res, err := storage.NewObjectsService(s).Get(bucket, object).Context(ctx).Download()
+			if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			defer res.Body.Close()
+			return ioutil.ReadAll(res.Body)
+		},
+		write: func(ctx context.Context, b []byte) error {
+			obj := &storage.Object{Name: object, ContentType: "application/json"}
+			_, err := storage.NewObjectsService(s).Insert(bucket, obj).Media(bytes.NewReader(b)).Context(ctx).Do()
+			return err
+		},
+	}, nil
+}
+
+// firestoreStore keeps a size in a document per resource
+type firestoreStore struct {
+	documents  *firestore.ProjectsDatabasesDocumentsService
+	collection string
+}
+
+// path is "{project}/{collection}"
+func newFirestoreStore(ctx context.Context, path string) (StateStore, error) {
+	elements := strings.Split(path, "/")
+	if len(elements) != 2 || elements[0] == "" || elements[1] == "" {
+		return nil, errors.New("invalid state store: firestore://" + path + ": expected firestore://{project}/{collection}")
+	}
+
+	s, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreStore{
+		documents:  firestore.NewProjectsDatabasesDocumentsService(s),
+		collection: "projects/" + elements[0] + "/databases/(default)/documents/" + elements[1],
+	}, nil
+}
+
+// document name of the key. the key is escaped because the document id can't contain "/"
+func (s *firestoreStore) name(key string) string {
+	return s.collection + "/" + url.QueryEscape(key)
+}
+
+func (s *firestoreStore) Get(ctx context.Context, key string) (*Size, error) {
+	doc, err := s.documents.Get(s.name(key)).Context(ctx).Do()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := doc.Fields["size"]
+	if !ok {
+		return nil, nil
+	}
+	var size Size
+	if err := json.Unmarshal([]byte(v.StringValue), &size); err != nil {
+		return nil, err
+	}
+	return &size, nil
+}
+
+func (s *firestoreStore) Put(ctx context.Context, key string, size *Size) error {
+	b, err := json.Marshal(size)
+	if err != nil {
+		return err
+	}
+	doc := &firestore.Document{
+		Fields: map[string]firestore.Value{
+			"key":  {StringValue: key},
+			"size": {StringValue: string(b)},
+		},
+	}
+	_, err = s.documents.Patch(s.name(key), doc).Context(ctx).Do()
+	return err
+}
+
+func (s *firestoreStore) Delete(ctx context.Context, key string) error {
+	_, err := s.documents.Delete(s.name(key)).Context(ctx).Do()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
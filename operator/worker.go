@@ -0,0 +1,310 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/future-architect/gcp-instance-scheduler/model"
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/net/context"
+)
+
+// resource identifies a target resource of an operator.
+// ID is unique in the operator (e.g. zone and name), and Name is shown in the report
+type resource struct {
+	ID   string
+	Name string
+}
+
+// named returns the resource whose name is unique in the operator
+func named(name string) resource {
+	return resource{ID: name, Name: name}
+}
+
+// worker runs the API calls of an operator on the bounded goroutines with the rate limiter,
+// and collects the result of each resource
+type worker struct {
+	ctx  context.Context
+	conf Config
+	sem  chan struct{}
+	wg   sync.WaitGroup
+
+	mu        sync.Mutex
+	waits     map[resource]func() error
+	retries   map[resource]int
+	modes     map[string]string
+	succeeds  map[string]bool
+	forgets   map[resource]string
+	dones     []string
+	alreadies []string
+	skips     []string
+	fails     []string
+	conflicts []string
+	err       error
+}
+
+func newWorker(ctx context.Context, conf Config) *worker {
+	n := conf.Concurrency
+	if n <= 0 {
+		n = DefaultConcurrency
+	}
+	return &worker{
+		ctx:      ctx,
+		conf:     conf,
+		sem:      make(chan struct{}, n),
+		waits:    make(map[resource]func() error),
+		retries:  make(map[resource]int),
+		modes:    make(map[string]string),
+		succeeds: make(map[string]bool),
+		forgets:  make(map[resource]string),
+	}
+}
+
+// call runs the API call for the resource on a worker.
+// f returns the function which waits for the started operation
+func (w *worker) call(res resource, f func() (func() error, error)) {
+	w.start(res, f, w.conf.Wait)
+}
+
+// callSync runs the API call like call, but sync always waits for the operation
+// because the following calls depend on it
+func (w *worker) callSync(res resource, f func() (func() error, error)) {
+	w.start(res, f, true)
+}
+
+func (w *worker) start(res resource, f func() (func() error, error), waiting bool) {
+	w.run(func() {
+		var wait func() error
+		err := w.exec(res, func() error {
+			var err error
+			wait, err = f()
+			return err
+		})
+		if err != nil {
+			w.abort(res, err)
+			return
+		}
+		if waiting && wait != nil {
+			w.mu.Lock()
+			w.waits[res] = wait
+			w.mu.Unlock()
+			return
+		}
+		w.done(res)
+	})
+}
+
+// exec runs the API call for the resource on the current goroutine with the rate limiter and the retry
+func (w *worker) exec(res resource, f func() error) error {
+	retries, err := w.conf.retry(w.ctx, func() error {
+		if err := w.limit(); err != nil {
+			return err
+		}
+		return f()
+	})
+	w.retried(res, retries)
+	return err
+}
+
+// run f on a goroutine when a worker is free
+func (w *worker) run(f func()) {
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+		f()
+	}()
+}
+
+// limit blocks until the rate limiter allows an API call
+func (w *worker) limit() error {
+	if w.conf.Limiter == nil {
+		return w.ctx.Err()
+	}
+	return w.conf.Limiter.Wait(w.ctx)
+}
+
+func (w *worker) retried(res resource, n int) {
+	if n == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.retries[res] += n
+}
+
+func (w *worker) done(res resource) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.succeeds[res.ID] = true
+	w.dones = append(w.dones, w.show(res))
+}
+
+// mode records how the resource is changed if it is not the default way of the operator
+func (w *worker) mode(res resource, mode string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.modes[res.ID] = mode
+}
+
+func (w *worker) already(res resource) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.succeeds[res.ID] = true
+	w.alreadies = append(w.alreadies, w.show(res))
+}
+
+func (w *worker) skip(res resource, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.skips = append(w.skips, skipped(res.Name, reason))
+}
+
+func (w *worker) fail(res resource, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fails = append(w.fails, failed(res.Name, err))
+	w.err = multierror.Append(w.err, errors.New(res.ID+": "+err.Error()))
+}
+
+// conflict records the resource changed by others after listing
+func (w *worker) conflict(res resource, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conflicts = append(w.conflicts, failed(res.Name, err))
+	w.err = multierror.Append(w.err, errors.New(res.ID+": "+err.Error()))
+}
+
+// abort records the error of the resource as a conflict if it was changed by others, or as a failure
+func (w *worker) abort(res resource, err error) {
+	if conflicted(err) {
+		w.conflict(res, err)
+		return
+	}
+	w.fail(res, err)
+}
+
+// forget deletes the saved size of the key from the state store at the end, if the resource is done or already done
+func (w *worker) forget(res resource, key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.forgets[res] = key
+}
+
+// show returns the name with the mode in the report. it must be called with the lock
+func (w *worker) show(res resource) string {
+	if mode, ok := w.modes[res.ID]; ok {
+		return skipped(res.Name, mode)
+	}
+	return res.Name
+}
+
+// sync waits for all calls and the operations to wait
+func (w *worker) sync() {
+	w.wg.Wait()
+
+	w.mu.Lock()
+	waits := w.waits
+	w.waits = make(map[resource]func() error)
+	w.mu.Unlock()
+
+	for res, wait := range waits {
+		res, wait := res, wait
+		w.run(func() {
+			if err := wait(); err != nil {
+				w.fail(res, err)
+				return
+			}
+			w.done(res)
+		})
+	}
+	w.wg.Wait()
+}
+
+// succeeded reports whether the resource is done or already done.
+// it must be called after sync
+func (w *worker) succeeded(res resource) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.succeeds[res.ID]
+}
+
+// clear deletes the saved sizes of the restored resources.
+// the size is saved again at the next shutdown, and the resource scaled down by the user in between is not restored
+func (w *worker) clear() {
+	if w.conf.DryRun {
+		return
+	}
+	w.mu.Lock()
+	forgets := w.forgets
+	w.forgets = make(map[resource]string)
+	w.mu.Unlock()
+
+	for res, key := range forgets {
+		if !w.succeeded(res) {
+			continue
+		}
+		res, key := res, key
+		w.run(func() {
+			err := w.exec(res, func() error {
+				return w.conf.State.Delete(w.ctx, key)
+			})
+			if err != nil {
+				w.fail(res, errors.New("deleting saved size failed: "+err.Error()))
+			}
+		})
+	}
+	w.wg.Wait()
+}
+
+// report waits for all calls and operations, and returns the results
+func (w *worker) report(instanceType string) (*model.Report, error) {
+	w.sync()
+	w.clear()
+
+	// the retries of the resources of the same name are summed up in the report
+	retries := make(map[string]int)
+	for res, n := range w.retries {
+		retries[res.Name] += n
+	}
+
+	return &model.Report{
+		InstanceType: instanceType,
+		DryRun:       w.conf.DryRun,
+		Partial:      w.ctx.Err() != nil,
+		Dones:        w.dones,
+		Alreadies:    w.alreadies,
+		Skips:        w.skips,
+		Fails:        w.fails,
+		Conflicts:    w.conflicts,
+		Retries:      retries,
+	}, w.err
+}
+
+// resource name and the reason in the report
+func skipped(name, reason string) string {
+	return name + " (" + reason + ")"
+}
+
+// resource name and the error in the report
+func failed(name string, err error) string {
+	return name + " (" + err.Error() + ")"
+}
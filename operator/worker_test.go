@@ -0,0 +1,73 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package operator
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestWorkerSameName(t *testing.T) {
+	w := newWorker(context.Background(), Config{Wait: true})
+	a := resource{ID: "asia-northeast1-a/web", Name: "web"}
+	b := resource{ID: "asia-northeast1-b/web", Name: "web"}
+	c := resource{ID: "asia-northeast1-c/web", Name: "web"}
+	w.call(a, func() (func() error, error) {
+		return func() error { return nil }, nil
+	})
+	w.call(b, func() (func() error, error) {
+		return func() error { return nil }, nil
+	})
+	w.call(c, func() (func() error, error) {
+		return func() error { return errors.New("broken") }, nil
+	})
+
+	report, err := w.report("test")
+	if err == nil {
+		t.Error("report() returns no error")
+	}
+	sort.Strings(report.Dones)
+	if len(report.Dones) != 2 || report.Dones[0] != "web" || report.Dones[1] != "web" {
+		t.Errorf("Dones = %v, want [web web]", report.Dones)
+	}
+	if len(report.Fails) != 1 {
+		t.Errorf("Fails = %v, want 1 failure", report.Fails)
+	}
+	if !w.succeeded(a) || !w.succeeded(b) || w.succeeded(c) {
+		t.Errorf("succeeded() = %v %v %v, want true true false", w.succeeded(a), w.succeeded(b), w.succeeded(c))
+	}
+}
+
+func TestWorkerMode(t *testing.T) {
+	w := newWorker(context.Background(), Config{})
+	a := resource{ID: "asia-northeast1-a/dev", Name: "dev"}
+	b := resource{ID: "asia-northeast1-b/dev", Name: "dev"}
+	w.mode(a, "suspended")
+	w.done(a)
+	w.done(b)
+
+	report, err := w.report("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(report.Dones)
+	if len(report.Dones) != 2 || report.Dones[0] != "dev" || report.Dones[1] != "dev (suspended)" {
+		t.Errorf("Dones = %v, want [dev dev (suspended)]", report.Dones)
+	}
+}
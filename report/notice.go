@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"github.com/future-architect/gcp-instance-scheduler/model"
 	"github.com/nlopes/slack"
+	"strings"
 )
 
 type Report struct {
-	ProjectID string
-	Command   string
-	Reports   []*model.Report
+	// target project IDs in order
+	ProjectIDs []string
+	Command    string
+	// reports of all projects. grouped by model.Report.Project
+	Reports []*model.Report
 }
 
 type slackNotifier struct {
@@ -25,12 +28,28 @@ func NewSlackNotifier(slackAPIToken, slackChannel string) *slackNotifier {
 }
 
 func (n *slackNotifier) Post(r Report) (string, error) {
-	text := fmt.Sprintf("Project(%s) %s Report\n", r.ProjectID, r.Command)
+	if len(r.ProjectIDs) <= 1 {
+		text := fmt.Sprintf("Project(%s) %s Report\n", strings.Join(r.ProjectIDs, ""), r.Command)
+		for _, detail := range r.Reports {
+			lines := detail.Show()
+			for _, line := range lines {
+				text += line + "\n"
+			}
+		}
+		return n.postInline(text)
+	}
 
-	for _, detail := range r.Reports {
-		lines := detail.Show()
-		for _, line := range lines {
-			text += line + "\n"
+	text := fmt.Sprintf("Projects(%d) %s Report\n", len(r.ProjectIDs), r.Command)
+	for _, projectID := range r.ProjectIDs {
+		text += fmt.Sprintf("Project(%s)\n", projectID)
+		for _, detail := range r.Reports {
+			if detail.Project != projectID {
+				continue
+			}
+			lines := detail.Show()
+			for _, line := range lines {
+				text += "  " + line + "\n"
+			}
 		}
 	}
 
@@ -0,0 +1,223 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package schedule
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const dateFormat = "2006-01-02"
+
+// Calendar is the list of holidays. e.g. public holidays and company shutdown days
+type Calendar struct {
+	Name string `yaml:"name"`
+	// ICS file or YAML file of date list. relative path from the config file
+	File string `yaml:"file"`
+	// holidays "yyyy-mm-dd"
+	Dates []string `yaml:"dates"`
+	// IANA time zone name to decide today (default UTC)
+	TimeZone string `yaml:"timeZone"`
+
+	loc   *time.Location
+	dates map[string]bool
+}
+
+// Exception overrides the schedule in the period
+type Exception struct {
+	// "yyyy-mm-dd" or "yyyy-mm-ddThh:mm" in the schedule time zone
+	From string `yaml:"from"`
+	// "yyyy-mm-dd" (inclusive) or "yyyy-mm-ddThh:mm" (exclusive). same as from if empty
+	To string `yaml:"to"`
+	// true keeps the resources running, false keeps them stopped
+	Running bool `yaml:"running"`
+
+	from time.Time
+	to   time.Time
+}
+
+func (c *Calendar) init(dir string) error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return err
+	}
+	c.loc = loc
+
+	dates := c.Dates
+	if c.File != "" {
+		path := c.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var fileDates []string
+		if strings.EqualFold(filepath.Ext(path), ".ics") {
+			fileDates, err = parseICS(b)
+		} else {
+			err = yaml.Unmarshal(b, &fileDates)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", c.File, err)
+		}
+		dates = append(dates, fileDates...)
+	}
+
+	c.dates = make(map[string]bool)
+	for _, d := range dates {
+		if _, err := time.Parse(dateFormat, d); err != nil {
+			return fmt.Errorf("invalid date %q: expected yyyy-mm-dd", d)
+		}
+		c.dates[d] = true
+	}
+	return nil
+}
+
+// Holiday reports whether t is a holiday in the calendar time zone
+func (c *Calendar) Holiday(t time.Time) bool {
+	return c.contains(t.In(c.loc))
+}
+
+// contains reports whether the date of t is a holiday
+func (c *Calendar) contains(t time.Time) bool {
+	return c.dates[t.Format(dateFormat)]
+}
+
+func (e *Exception) init(loc *time.Location) error {
+	from, _, err := parseDateTime(e.From, loc)
+	if err != nil {
+		return err
+	}
+	to := e.To
+	if to == "" {
+		to = e.From
+	}
+	end, endWholeDay, err := parseDateTime(to, loc)
+	if err != nil {
+		return err
+	}
+	if endWholeDay {
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(from) {
+		return errors.New("exception to must be after from")
+	}
+	e.from, e.to = from, end
+	return nil
+}
+
+func (e *Exception) contains(t time.Time) bool {
+	return !t.Before(e.from) && t.Before(e.to)
+}
+
+// parse "yyyy-mm-dd" or "yyyy-mm-ddThh:mm". wholeDay is true for the date format
+func parseDateTime(v string, loc *time.Location) (t time.Time, wholeDay bool, err error) {
+	if t, err = time.ParseInLocation(dateFormat, v, loc); err == nil {
+		return t, true, nil
+	}
+	if t, err = time.ParseInLocation("2006-01-02T15:04", v, loc); err == nil {
+		return t, false, nil
+	}
+	return t, false, fmt.Errorf("invalid date %q: expected yyyy-mm-dd or yyyy-mm-ddThh:mm", v)
+}
+
+// parseICS returns the dates of all events in the iCalendar file.
+// an all-day event which has DTEND covers the days before DTEND
+func parseICS(b []byte) ([]string, error) {
+	var res []string
+	var start, end time.Time
+
+	for _, line := range unfoldICS(b) {
+		name, value := splitICSLine(line)
+		var err error
+		switch name {
+		case "BEGIN":
+			if value == "VEVENT" {
+				start, end = time.Time{}, time.Time{}
+			}
+		case "DTSTART":
+			start, err = parseICSDate(value)
+		case "DTEND":
+			end, err = parseICSDate(value)
+		case "END":
+			if value != "VEVENT" {
+				continue
+			}
+			if start.IsZero() {
+				return nil, errors.New("VEVENT without DTSTART")
+			}
+			res = append(res, start.Format(dateFormat))
+			for d := start.AddDate(0, 0, 1); d.Before(end); d = d.AddDate(0, 0, 1) {
+				res = append(res, d.Format(dateFormat))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// join the folded lines which start with a space or a tab
+func unfoldICS(b []byte) []string {
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// e.g. "DTSTART;VALUE=DATE:20261103" -> "DTSTART", "20261103"
+func splitICSLine(line string) (name, value string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return line, ""
+	}
+	name = line[:i]
+	if j := strings.Index(name, ";"); j >= 0 {
+		name = name[:j]
+	}
+	return strings.ToUpper(name), line[i+1:]
+}
+
+// the date part of "20261103" or "20261103T000000Z"
+func parseICSDate(v string) (time.Time, error) {
+	if len(v) < 8 {
+		return time.Time{}, fmt.Errorf("invalid ics date %q", v)
+	}
+	return time.Parse("20060102", v[:8])
+}
@@ -0,0 +1,132 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package schedule
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseICS(t *testing.T) {
+	ics := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"DTSTART;VALUE=DATE:20261103\r\n" +
+		"DTEND;VALUE=DATE:20261104\r\n" +
+		"SUMMARY:Culture\r\n" +
+		" Day\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"DTSTART;VALUE=DATE:20261229\r\n" +
+		"DTEND;VALUE=DATE:20270102\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"DTSTART:20261123T000000Z\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	got, err := parseICS([]byte(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2026-11-03", "2026-12-29", "2026-12-30", "2026-12-31", "2027-01-01", "2026-11-23"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseICS() = %v, want %v", got, want)
+	}
+}
+
+func TestParseICSWithoutStart(t *testing.T) {
+	if _, err := parseICS([]byte("BEGIN:VEVENT\nSUMMARY:broken\nEND:VEVENT\n")); err == nil {
+		t.Error("parseICS() returns no error for VEVENT without DTSTART")
+	}
+}
+
+func TestException(t *testing.T) {
+	loc := time.UTC
+	tests := []struct {
+		name string
+		from string
+		to   string
+		t    time.Time
+		want bool
+	}{
+		{"whole day", "2026-10-24", "", time.Date(2026, 10, 24, 23, 59, 0, 0, loc), true},
+		{"next day", "2026-10-24", "", time.Date(2026, 10, 25, 0, 0, 0, 0, loc), false},
+		{"inclusive to date", "2026-10-24", "2026-10-25", time.Date(2026, 10, 25, 12, 0, 0, 0, loc), true},
+		{"from time", "2026-10-30T12:00", "2026-10-30T19:00", time.Date(2026, 10, 30, 12, 0, 0, 0, loc), true},
+		{"exclusive to time", "2026-10-30T12:00", "2026-10-30T19:00", time.Date(2026, 10, 30, 19, 0, 0, 0, loc), false},
+		{"before from", "2026-10-30T12:00", "2026-10-30T19:00", time.Date(2026, 10, 30, 11, 59, 0, 0, loc), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Exception{From: tt.from, To: tt.to}
+			if err := e.init(loc); err != nil {
+				t.Fatal(err)
+			}
+			if got := e.contains(tt.t); got != tt.want {
+				t.Errorf("contains(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExceptionToBeforeFrom(t *testing.T) {
+	e := &Exception{From: "2026-10-30T19:00", To: "2026-10-30T12:00"}
+	if err := e.init(time.UTC); err == nil {
+		t.Error("init() returns no error for to before from")
+	}
+}
+
+func TestConfigException(t *testing.T) {
+	c, err := Parse([]byte(`
+timeZone: Asia/Tokyo
+calendar: company
+calendars:
+  - name: company
+    dates: ["2026-10-26"]
+    timeZone: Asia/Tokyo
+default: dev
+exceptions:
+  - from: "2026-10-24"
+    running: true
+schedules:
+  - name: dev
+    timeZone: Asia/Tokyo
+    start: "09:00"
+    stop: "19:00"
+    exceptions:
+      - from: "2026-10-26T09:00"
+        to: "2026-10-26T12:00"
+        running: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jst, _ := time.LoadLocation("Asia/Tokyo")
+
+	if e := c.Exception(time.Date(2026, 10, 24, 10, 0, 0, 0, jst)); e == nil || !e.Running {
+		t.Errorf("top-level exception is not found: %v", e)
+	}
+	if e := c.Exception(time.Date(2026, 10, 26, 10, 0, 0, 0, jst)); e == nil || !e.Running {
+		t.Errorf("exception of the default schedule is not found: %v", e)
+	}
+	if e := c.Exception(time.Date(2026, 10, 26, 13, 0, 0, 0, jst)); e != nil {
+		t.Errorf("unexpected exception: %v", e)
+	}
+	if !c.Holiday(time.Date(2026, 10, 26, 13, 0, 0, 0, jst)) {
+		t.Error("2026-10-26 is not a holiday")
+	}
+}
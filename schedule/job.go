@@ -0,0 +1,50 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package schedule
+
+import (
+	"errors"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Job is a command which the daemon runs periodically
+type Job struct {
+	// command name. "stop", "start" or "ensure" ("apply" is an alias of "ensure")
+	Command string `yaml:"command"`
+	// standard 5 fields cron expression. e.g. "0 9 * * 1-5"
+	Cron string `yaml:"cron"`
+	// IANA time zone name of the cron expression. e.g. Asia/Tokyo (default UTC)
+	TimeZone string `yaml:"timeZone"`
+}
+
+// Spec returns the cron spec with the time zone
+func (j *Job) Spec() string {
+	if j.TimeZone == "" {
+		return j.Cron
+	}
+	return "CRON_TZ=" + j.TimeZone + " " + j.Cron
+}
+
+func (j *Job) init() error {
+	switch j.Command {
+	case "stop", "start", "ensure", "apply":
+	default:
+		return errors.New("unknown command: " + j.Command)
+	}
+	_, err := cron.ParseStandard(j.Spec())
+	return err
+}
@@ -0,0 +1,277 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the contents of the schedule config file
+type Config struct {
+	Schedules []*Schedule `yaml:"schedules"`
+	Calendars []*Calendar `yaml:"calendars"`
+	// calendar name of stop and start commands. start is skipped on its holidays
+	Calendar string `yaml:"calendar"`
+	// one-off exceptions of stop and start commands in the time zone of the config.
+	// they take priority over the holidays, and the exceptions of the default schedule are also applied
+	Exceptions []*Exception `yaml:"exceptions"`
+	// schedule name which ensure command applies to the resources labeled "true"
+	Default string `yaml:"default"`
+	// IANA time zone name of the protection label values (default UTC)
+	TimeZone string `yaml:"timeZone"`
+	// used by daemon command only
+	Jobs []*Job `yaml:"jobs"`
+
+	loc *time.Location
+}
+
+// Schedule is the working hours of the resources labeled with its name.
+// e.g. state-scheduler: weekday-0900-1900-jst
+type Schedule struct {
+	// label value of the target resources
+	Name string `yaml:"name"`
+	// IANA time zone name. e.g. Asia/Tokyo (default UTC)
+	TimeZone string `yaml:"timeZone"`
+	// running days of week. e.g. [Mon, Tue, Wed, Thu, Fri] (default every day)
+	Days []string `yaml:"days"`
+	// start time "hh:mm"
+	Start string `yaml:"start"`
+	// stop time "hh:mm". the resources run over midnight if stop is earlier than start
+	Stop string `yaml:"stop"`
+	// calendar name. the resources do not run on its holidays
+	Calendar string `yaml:"calendar"`
+	// one-off exceptions which take priority over the days, times and holidays
+	Exceptions []*Exception `yaml:"exceptions"`
+
+	calendar *Calendar
+	loc      *time.Location
+	days     map[time.Weekday]bool
+	start    int
+	stop     int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Load reads the schedule config file (YAML or JSON)
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(b, filepath.Dir(path))
+}
+
+// Parse parses the schedule config and validates each schedule.
+// calendar files are relative to the current directory
+func Parse(b []byte) (*Config, error) {
+	return parse(b, ".")
+}
+
+func parse(b []byte, dir string) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	c.loc = loc
+
+	calendars := make(map[string]*Calendar)
+	for _, cal := range c.Calendars {
+		if err := cal.init(dir); err != nil {
+			return nil, fmt.Errorf("calendar %v: %v", cal.Name, err)
+		}
+		if calendars[cal.Name] != nil {
+			return nil, fmt.Errorf("calendar %v: duplicated name", cal.Name)
+		}
+		calendars[cal.Name] = cal
+	}
+	if c.Calendar != "" && calendars[c.Calendar] == nil {
+		return nil, fmt.Errorf("calendar %v: not found", c.Calendar)
+	}
+	for i, e := range c.Exceptions {
+		if err := e.init(c.loc); err != nil {
+			return nil, fmt.Errorf("exceptions[%d]: %v", i, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, s := range c.Schedules {
+		if err := s.init(calendars); err != nil {
+			return nil, fmt.Errorf("schedule %v: %v", s.Name, err)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("schedule %v: duplicated name", s.Name)
+		}
+		names[s.Name] = true
+	}
+	if c.Default != "" && !names[c.Default] {
+		return nil, fmt.Errorf("default schedule %v: not found", c.Default)
+	}
+	for i, j := range c.Jobs {
+		if err := j.init(); err != nil {
+			return nil, fmt.Errorf("jobs[%d]: %v", i, err)
+		}
+	}
+	return &c, nil
+}
+
+// Location returns the time zone of the protection label values
+func (c *Config) Location() *time.Location {
+	return c.loc
+}
+
+// Holiday reports whether t is a holiday of the calendar of stop and start commands
+func (c *Config) Holiday(t time.Time) bool {
+	for _, cal := range c.Calendars {
+		if cal.Name == c.Calendar {
+			return cal.Holiday(t)
+		}
+	}
+	return false
+}
+
+// Exception returns the exception of stop and start commands at t, or nil
+func (c *Config) Exception(t time.Time) *Exception {
+	exceptions := c.Exceptions
+	if s := c.Find(c.Default); s != nil {
+		exceptions = append(append([]*Exception{}, exceptions...), s.Exceptions...)
+	}
+	for _, e := range exceptions {
+		if e.contains(t) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Find returns the schedule which has the name, or nil
+func (c *Config) Find(name string) *Schedule {
+	for _, s := range c.Schedules {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *Schedule) init(calendars map[string]*Calendar) error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if s.Name == "true" {
+		return errors.New(`"true" is reserved. use default to apply a schedule to "true"`)
+	}
+
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return err
+	}
+	s.loc = loc
+
+	s.days = make(map[time.Weekday]bool)
+	for _, d := range s.Days {
+		w, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return errors.New("unknown day of week: " + d)
+		}
+		s.days[w] = true
+	}
+	if len(s.days) == 0 {
+		for _, w := range weekdays {
+			s.days[w] = true
+		}
+	}
+
+	if s.start, err = parseClock(s.Start); err != nil {
+		return err
+	}
+	if s.stop, err = parseClock(s.Stop); err != nil {
+		return err
+	}
+	if s.start == s.stop {
+		return errors.New("start and stop are same time")
+	}
+
+	if s.Calendar != "" {
+		if s.calendar = calendars[s.Calendar]; s.calendar == nil {
+			return errors.New("calendar not found: " + s.Calendar)
+		}
+	}
+	for i, e := range s.Exceptions {
+		if err := e.init(s.loc); err != nil {
+			return fmt.Errorf("exceptions[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Active reports whether the resources should be running at t
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+	for _, e := range s.Exceptions {
+		if e.contains(t) {
+			return e.Running
+		}
+	}
+
+	now := t.Hour()*60 + t.Minute()
+
+	if s.start < s.stop {
+		return s.workday(t) && s.start <= now && now < s.stop
+	}
+
+	// running over midnight. the day of week is the day which starts
+	if s.workday(t) && s.start <= now {
+		return true
+	}
+	return s.workday(t.AddDate(0, 0, -1)) && now < s.stop
+}
+
+// workday reports whether the resources run on the date of t
+func (s *Schedule) workday(t time.Time) bool {
+	if s.calendar != nil && s.calendar.contains(t) {
+		return false
+	}
+	return s.days[t.Weekday()]
+}
+
+// parse "hh:mm" to minutes from midnight
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: expected hh:mm", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	c, err := Parse([]byte(`
+calendars:
+  - name: jp
+    dates: ["2026-11-03"]
+    timeZone: Asia/Tokyo
+schedules:
+  - name: weekday
+    timeZone: Asia/Tokyo
+    days: [Mon, Tue, Wed, Thu, Fri]
+    start: "09:00"
+    stop: "19:00"
+    calendar: jp
+    exceptions:
+      - from: "2026-10-24"
+        running: true
+      - from: "2026-10-30T12:00"
+        to: "2026-10-30T19:00"
+        running: false
+  - name: night
+    timeZone: Asia/Tokyo
+    days: [Fri]
+    start: "22:00"
+    stop: "02:00"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jst, _ := time.LoadLocation("Asia/Tokyo")
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2026, 10, day, hour, min, 0, 0, jst)
+	}
+
+	tests := []struct {
+		schedule string
+		name     string
+		t        time.Time
+		want     bool
+	}{
+		{"weekday", "start time", at(29, 9, 0), true},
+		{"weekday", "before start", at(29, 8, 59), false},
+		{"weekday", "stop time", at(29, 19, 0), false},
+		{"weekday", "other time zone", time.Date(2026, 10, 29, 0, 0, 0, 0, time.UTC), true},
+		{"weekday", "sunday", at(25, 10, 0), false},
+		{"weekday", "holiday", time.Date(2026, 11, 3, 10, 0, 0, 0, jst), false},
+		{"weekday", "running exception on saturday", at(24, 3, 0), true},
+		{"weekday", "stopped exception", at(30, 12, 0), false},
+		{"weekday", "after stopped exception", at(30, 11, 59), true},
+		{"night", "friday night", at(30, 23, 0), true},
+		{"night", "after midnight", at(31, 1, 59), true},
+		{"night", "stop after midnight", at(31, 2, 0), false},
+		{"night", "saturday night", at(31, 23, 0), false},
+		{"night", "thursday after midnight", at(30, 1, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule+"/"+tt.name, func(t *testing.T) {
+			if got := c.Find(tt.schedule).Active(tt.t); got != tt.want {
+				t.Errorf("Active(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"same start and stop", "schedules: [{name: a, start: '09:00', stop: '09:00'}]"},
+		{"reserved name", "schedules: [{name: 'true', start: '09:00', stop: '19:00'}]"},
+		{"unknown day", "schedules: [{name: a, days: [Mo], start: '09:00', stop: '19:00'}]"},
+		{"invalid time", "schedules: [{name: a, start: '9am', stop: '19:00'}]"},
+		{"unknown calendar", "schedules: [{name: a, start: '09:00', stop: '19:00', calendar: x}]"},
+		{"duplicated name", "schedules: [{name: a, start: '09:00', stop: '19:00'}, {name: a, start: '09:00', stop: '19:00'}]"},
+		{"unknown default", "default: b\nschedules: [{name: a, start: '09:00', stop: '19:00'}]"},
+		{"unknown field", "schedule: []"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.config)); err == nil {
+				t.Errorf("Parse() returns no error")
+			}
+		})
+	}
+}
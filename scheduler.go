@@ -19,8 +19,10 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"strings"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/future-architect/gcp-instance-scheduler/schedule"
 	"github.com/future-architect/gcp-instance-scheduler/scheduler"
 	"github.com/kelseyhightower/envconfig"
 	"golang.org/x/net/context"
@@ -32,6 +34,10 @@ type Env struct {
 	SlackNotify  bool   `envconfig:"SLACK_ENABLE" required:"true"`
 	SlackToken   string `envconfig:"SLACK_API_TOKEN"`
 	SlackChannel string `envconfig:"SLACK_CHANNEL"`
+	// schedule config file path which is deployed with the function
+	ScheduleConfig string `envconfig:"SCHEDULE_CONFIG"`
+	// state store which saves the sizes at shutdown (default Firestore collection "state-scheduler" in the project)
+	StateStore string `envconfig:"STATE_STORE"`
 }
 
 func SwitchInstanceState(ctx context.Context, msg *pubsub.Message) error {
@@ -54,6 +60,32 @@ func SwitchInstanceState(ctx context.Context, msg *pubsub.Message) error {
 
 	log.Printf("Project ID: %v", e.ProjectID)
 	opts := scheduler.NewOptions(e.ProjectID, e.SlackToken, e.SlackChannel, e.SlackNotify)
+	if len(payload.Projects) > 0 || len(payload.Folders) > 0 || len(payload.Organizations) > 0 {
+		// the message designates the target projects instead of the function project
+		opts.Project = strings.Join(payload.Projects, ",")
+		opts.Folders = payload.Folders
+		opts.Organizations = payload.Organizations
+	}
+	opts.Targets = payload.Targets
+	opts.Excludes = payload.Excludes
+	opts.DryRun = payload.DryRun
+	opts.Suspend = payload.Suspend
+	opts.SpannerProcessingUnits = payload.SpannerProcessingUnits
+	opts.Wait = payload.Wait
+	opts.Concurrency = payload.Concurrency
+	opts.RateLimit = payload.RateLimit
+	opts.Parallel = payload.Parallel
+	opts.Retry = payload.Retry
+	opts.StateStore = e.StateStore
+	if opts.StateStore == "" {
+		// the local file system of the function is not persistent
+		opts.StateStore = "firestore://" + e.ProjectID + "/" + scheduler.Label
+	}
+	if e.ScheduleConfig != "" {
+		if opts.Schedules, err = schedule.Load(e.ScheduleConfig); err != nil {
+			return err
+		}
+	}
 
 	switch payload.Command {
 	case "start":
@@ -64,6 +96,13 @@ func SwitchInstanceState(ctx context.Context, msg *pubsub.Message) error {
 		if err := scheduler.Shutdown(ctx, opts); err != nil {
 			return err
 		}
+	case "ensure", "apply":
+		if opts.Schedules == nil {
+			return errors.New("missing environment variable: SCHEDULE_CONFIG")
+		}
+		if err := scheduler.Ensure(ctx, opts); err != nil {
+			return err
+		}
 	default:
 		return errors.New("unknown command type")
 	}
@@ -73,6 +112,32 @@ func SwitchInstanceState(ctx context.Context, msg *pubsub.Message) error {
 
 type Payload struct {
 	Command string `json:"command"`
+	// target project IDs (default the function project)
+	Projects []string `json:"projects"`
+	// folder IDs. the active projects under the folders are added
+	Folders []string `json:"folders"`
+	// organization IDs. all active projects in the organizations are added
+	Organizations []string `json:"organizations"`
+	// operator names to run. e.g. ["ComputeEngine", "SQL"]
+	Targets []string `json:"targets"`
+	// operator names not to run
+	Excludes []string `json:"excludes"`
+	// only report the target resources if true
+	DryRun bool `json:"dryRun"`
+	// suspend the GCE instances instead of stopping them if true
+	Suspend bool `json:"suspend"`
+	// processing units of the Spanner instances at shutdown. e.g. 100
+	SpannerProcessingUnits int64 `json:"spannerProcessingUnits"`
+	// wait for the operations to report the final status if true
+	Wait bool `json:"wait"`
+	// number of the concurrent API calls in an operator
+	Concurrency int `json:"concurrency"`
+	// API calls per second
+	RateLimit float64 `json:"rateLimit"`
+	// run independent operators in parallel if true
+	Parallel bool `json:"parallel"`
+	// max retries per error class. e.g. {"rateLimit": 10, "unavailable": 5}
+	Retry map[string]int `json:"retry"`
 }
 
 func decode(payload []byte) (p Payload, err error) {
@@ -0,0 +1,138 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package scheduler
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"golang.org/x/net/context"
+	crmv1 "google.golang.org/api/cloudresourcemanager/v1"
+	crmv2 "google.golang.org/api/cloudresourcemanager/v2"
+)
+
+// projects returns the target project IDs without duplication.
+// the folders and the organizations are expanded to their active projects by Cloud Resource Manager
+func (op *Options) projects(ctx context.Context) ([]string, error) {
+	var res []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			res = append(res, id)
+		}
+	}
+
+	for _, id := range strings.Split(op.Project, ",") {
+		add(id)
+	}
+
+	if len(op.Folders) > 0 || len(op.Organizations) > 0 {
+		r, err := newResolver(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range op.Folders {
+			ids, err := r.expand("folders/" + strings.TrimPrefix(id, "folders/"))
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				add(id)
+			}
+		}
+		for _, id := range op.Organizations {
+			ids, err := r.expand("organizations/" + strings.TrimPrefix(id, "organizations/"))
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				add(id)
+			}
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, errors.New("no target project")
+	}
+	log.Printf("Target projects: %v", strings.Join(res, ", "))
+	return res, nil
+}
+
+// resolver expands a folder or an organization to the projects
+type resolver struct {
+	ctx      context.Context
+	projects *crmv1.ProjectsService
+	folders  *crmv2.FoldersService
+}
+
+func newResolver(ctx context.Context) (*resolver, error) {
+	v1, err := crmv1.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v2, err := crmv2.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &resolver{
+		ctx:      ctx,
+		projects: crmv1.NewProjectsService(v1),
+		folders:  crmv2.NewFoldersService(v2),
+	}, nil
+}
+
+// expand returns the active project IDs under the parent and its sub folders.
+// parent is "folders/{id}" or "organizations/{id}"
+func (r *resolver) expand(parent string) ([]string, error) {
+	elements := strings.Split(parent, "/")
+	parentType := strings.TrimSuffix(elements[0], "s") // folder or organization
+	filter := "parent.type:" + parentType + " parent.id:" + elements[1] + " lifecycleState:ACTIVE"
+
+	var res []string
+	err := r.projects.List().Filter(filter).Pages(r.ctx, func(list *crmv1.ListProjectsResponse) error {
+		for _, p := range list.Projects {
+			res = append(res, p.ProjectId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var subFolders []string
+	err = r.folders.List().Parent(parent).Pages(r.ctx, func(list *crmv2.ListFoldersResponse) error {
+		for _, f := range list.Folders {
+			if f.LifecycleState == "ACTIVE" {
+				subFolders = append(subFolders, f.Name) // e.g. folders/1234
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range subFolders {
+		ids, err := r.expand(f)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ids...)
+	}
+	return res, nil
+}
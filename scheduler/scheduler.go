@@ -16,25 +16,60 @@
 package scheduler
 
 import (
+	"errors"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/future-architect/gcp-instance-scheduler/model"
 	"github.com/future-architect/gcp-instance-scheduler/operator"
 	"github.com/future-architect/gcp-instance-scheduler/report"
+	"github.com/future-architect/gcp-instance-scheduler/schedule"
 
 	"github.com/hashicorp/go-multierror"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 )
 
 // Operation target label name
 const Label = "state-scheduler"
 
 type Options struct {
-	Project      string
-	SlackEnable  bool
-	SlackToken   string
-	SlackChannel string
+	// project ID. comma separated for multiple projects
+	Project string
+	// folder IDs. the active projects under the folders and their sub folders are added
+	Folders []string
+	// organization IDs. all active projects in the organizations are added
+	Organizations []string
+	SlackEnable   bool
+	SlackToken    string
+	SlackChannel  string
+	// operator names to run. all registered operators run if empty
+	Targets []string
+	// operator names not to run
+	Excludes []string
+	// list the target resources without stopping or starting them
+	DryRun bool
+	// suspend the GCE instances instead of stopping them unless the mode label is set
+	Suspend bool
+	// processing units of the Spanner instances at shutdown (default operator.DefaultSpannerProcessingUnits)
+	SpannerProcessingUnits int64
+	// wait for the operations and report the final status
+	Wait bool
+	// number of the concurrent API calls in an operator (default operator.DefaultConcurrency)
+	Concurrency int
+	// API calls per second in a run (default operator.DefaultRateLimit)
+	RateLimit float64
+	// run the operators of the same stage in parallel
+	Parallel bool
+	// max retries per error class which overwrite operator.DefaultRetry. e.g. {"rateLimit": 10}
+	Retry map[string]int
+	// location of the state store which saves the sizes at shutdown (default operator.DefaultStateStore)
+	// e.g. gs://bucket/state.json, firestore://project/collection or a local file path
+	StateStore string
+	// named schedules used as the label value
+	Schedules *schedule.Config
 }
 
 func NewOptions(projectID, slackToken, slackChannel string, slackEnable bool) *Options {
@@ -46,123 +81,322 @@ func NewOptions(projectID, slackToken, slackChannel string, slackEnable bool) *O
 	}
 }
 
-func Shutdown(ctx context.Context, op *Options) error {
-	projectID := op.Project
+func (op *Options) config(ctx context.Context) (operator.Config, error) {
+	retry, err := operator.DefaultRetry().WithMaxRetries(op.Retry)
+	if err != nil {
+		return operator.Config{}, err
+	}
 
-	var errorLog error
-	var result []*model.Report
+	location := op.StateStore
+	if location == "" {
+		location = operator.DefaultStateStore
+	}
+	state, err := operator.NewStateStore(ctx, location)
+	if err != nil {
+		return operator.Config{}, err
+	}
 
+	rateLimit := op.RateLimit
+	if rateLimit <= 0 {
+		rateLimit = operator.DefaultRateLimit
+	}
+
+	conf := operator.Config{
+		DryRun:                 op.DryRun,
+		Suspend:                op.Suspend,
+		SpannerProcessingUnits: op.SpannerProcessingUnits,
+		Wait:                   op.Wait,
+		Concurrency:            op.Concurrency,
+		// shared by all operators in the run
+		Limiter: rate.NewLimiter(rate.Limit(rateLimit), 1),
+		Retry:   retry,
+		State:   state,
+	}
+	if op.Schedules != nil {
+		conf.Location = op.Schedules.Location()
+	}
+	return conf, nil
+}
 
-	if err := operator.SetLableIfNoLabel(ctx, projectID, Label); err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Error in setting labels on GKE cluster: %v", err)
+// command name in the report
+func (op *Options) command(name string) string {
+	if op.DryRun {
+		return name + " (dry-run)"
 	}
-	rpt, err := operator.GKENodePool(ctx, projectID).Filter(Label, "true").Resize(0)
+	return name
+}
+
+func Shutdown(ctx context.Context, op *Options) error {
+	stages, err := operator.Select(op.Targets, op.Excludes)
 	if err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Some error occured in stopping gke node pool: %v", err)
-	} else {
-		result = append(result, rpt)
-		log.Println(strings.Join(rpt.Show(), "\n"))
+		return err
 	}
 
-	rpt, err = operator.InstanceGroup(ctx, projectID).Filter(Label, "true").Resize(0)
+	conf, err := op.config(ctx)
 	if err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Some error occured in stopping instances group: %v", err)
-	} else {
-		result = append(result, rpt)
-		log.Println(strings.Join(rpt.Show(), "\n"))
+		return err
+	}
+	projects, err := op.projects(ctx)
+	if err != nil {
+		return err
+	}
+
+	if reason := op.skipReason(time.Now(), false); reason != "" {
+		log.Printf("Shutdown is skipped: %v", reason)
+		return notify(op, op.command("Shutdown")+" (skipped: "+reason+")", projects, nil, nil)
 	}
 
-	rpt, err = operator.ComputeEngine(ctx, projectID).Filter(Label, "true").Stop()
+	var errorLog error
+	var result []*model.Report
+	for _, project := range projects {
+		if err := interrupted(ctx); err != nil {
+			errorLog = multierror.Append(errorLog, err)
+			break
+		}
+		rpts, err := stop(ctx, op, conf, project, stages, "true")
+		if err != nil {
+			errorLog = multierror.Append(errorLog, err)
+		}
+		result = append(result, rpts...)
+	}
+	return notify(op, op.command("Shutdown"), projects, result, errorLog)
+}
+
+func Restart(ctx context.Context, op *Options) error {
+	stages, err := operator.Select(op.Targets, op.Excludes)
 	if err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Some error occured in stopping gce instances: %v", err)
-	} else {
-		result = append(result, rpt)
-		log.Println(strings.Join(rpt.Show(), "\n"))
+		return err
 	}
 
-	rpt, err = operator.SQL(ctx, projectID).Filter(Label, "true").Stop()
+	conf, err := op.config(ctx)
 	if err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Some error occured in stopping sql instances: %v", err)
-	} else {
-		result = append(result, rpt)
-		log.Println(strings.Join(rpt.Show(), "\n"))
+		return err
+	}
+	projects, err := op.projects(ctx)
+	if err != nil {
+		return err
 	}
 
-	if !op.SlackEnable {
-		log.Printf("done.")
-		return errorLog
+	if reason := op.skipReason(time.Now(), true); reason != "" {
+		log.Printf("Restart is skipped: %v", reason)
+		return notify(op, op.command("Restart")+" (skipped: "+reason+")", projects, nil, nil)
 	}
 
-	_, err = report.NewSlackNotifier(op.SlackToken, op.SlackChannel).Post(report.Report{
-		ProjectID: projectID,
-		Reports:   result,
-		Command:   "Shutdown",
-	})
+	var errorLog error
+	var result []*model.Report
+	for _, project := range projects {
+		if err := interrupted(ctx); err != nil {
+			errorLog = multierror.Append(errorLog, err)
+			break
+		}
+		rpts, err := start(ctx, op, conf, project, stages, "true")
+		if err != nil {
+			errorLog = multierror.Append(errorLog, err)
+		}
+		result = append(result, rpts...)
+	}
+	return notify(op, op.command("Restart"), projects, result, errorLog)
+}
+
+// skipReason returns the reason why stop (running=false) or restart (running=true) command is skipped at t,
+// or "" if it runs. the exceptions take priority over the holidays
+func (op *Options) skipReason(t time.Time, running bool) string {
+	if op.Schedules == nil {
+		return ""
+	}
+	if e := op.Schedules.Exception(t); e != nil {
+		if e.Running != running {
+			return "exception from " + e.From
+		}
+		return ""
+	}
+	if running && op.Schedules.Holiday(t) {
+		return "holiday of calendar " + op.Schedules.Calendar
+	}
+	return ""
+}
+
+// Ensure converges the labeled resources to the desired state of their schedules.
+// The resources labeled "true" follow the default schedule if configured.
+// Only the resources which deviate from the desired state are stopped or started,
+// so missed or duplicated triggers are harmless.
+func Ensure(ctx context.Context, op *Options) error {
+	if op.Schedules == nil || len(op.Schedules.Schedules) == 0 {
+		return errors.New("no schedule is configured")
+	}
+
+	stages, err := operator.Select(op.Targets, op.Excludes)
 	if err != nil {
-		log.Println("error in Slack notification:", err)
-		return multierror.Append(errorLog, err)
+		return err
+	}
+	conf, err := op.config(ctx)
+	if err != nil {
+		return err
+	}
+	projects, err := op.projects(ctx)
+	if err != nil {
+		return err
 	}
 
-	log.Printf("done.")
-	return errorLog
+	var errorLog error
+	var result []*model.Report
+
+	now := time.Now()
+projects:
+	for _, project := range projects {
+		for _, s := range op.Schedules.Schedules {
+			values := []string{s.Name}
+			if s.Name == op.Schedules.Default {
+				values = append(values, "true")
+			}
+
+			active := s.Active(now)
+			for _, value := range values {
+				if err := interrupted(ctx); err != nil {
+					errorLog = multierror.Append(errorLog, err)
+					break projects
+				}
+
+				var rpts []*model.Report
+				var err error
+				if active {
+					log.Printf("Schedule %v is active: ensure the resources labeled %v in %v are running", s.Name, value, project)
+					rpts, err = start(ctx, op, conf, project, stages, value)
+				} else {
+					log.Printf("Schedule %v is inactive: ensure the resources labeled %v in %v are stopped", s.Name, value, project)
+					rpts, err = stop(ctx, op, conf, project, stages, value)
+				}
+				if err != nil {
+					errorLog = multierror.Append(errorLog, err)
+				}
+				result = append(result, rpts...)
+			}
+		}
+	}
+
+	return notify(op, op.command("Ensure"), projects, result, errorLog)
 }
 
-func Restart(ctx context.Context, op *Options) error {
-	projectID := op.Project
+// stop the resources labeled with the value in shutdown order
+func stop(ctx context.Context, op *Options, conf operator.Config, project string, stages [][]operator.Factory, value string) ([]*model.Report, error) {
+	var errorLog error
+	var result []*model.Report
+
+	for _, stage := range stages {
+		if err := interrupted(ctx); err != nil {
+			return result, multierror.Append(errorLog, err)
+		}
+		rpts, err := runStage(ctx, op, conf, project, stage, value, true)
+		if err != nil {
+			errorLog = multierror.Append(errorLog, err)
+		}
+		result = append(result, rpts...)
+	}
+	return result, errorLog
+}
 
+// start the resources labeled with the value in reverse order of shutdown
+func start(ctx context.Context, op *Options, conf operator.Config, project string, stages [][]operator.Factory, value string) ([]*model.Report, error) {
 	var errorLog error
 	var result []*model.Report
 
-	rpt, err := operator.SQL(ctx, projectID).Filter(Label, "true").Start()
-	if err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Some error occurred in starting SQL: %v\n", err)
-	} else {
-		result = append(result, rpt)
-		log.Println(strings.Join(rpt.Show(), "\n"))
+	for i := len(stages) - 1; i >= 0; i-- {
+		if err := interrupted(ctx); err != nil {
+			return result, multierror.Append(errorLog, err)
+		}
+		var factories []operator.Factory
+		for j := len(stages[i]) - 1; j >= 0; j-- {
+			factories = append(factories, stages[i][j])
+		}
+
+		rpts, err := runStage(ctx, op, conf, project, factories, value, false)
+		if err != nil {
+			errorLog = multierror.Append(errorLog, err)
+		}
+		result = append(result, rpts...)
 	}
+	return result, errorLog
+}
 
-	rpt, err = operator.ComputeEngine(ctx, projectID).Filter(Label, "true").Start()
-	if err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Some error occurred in starting compute engine: %v\n", err)
-	} else {
-		result = append(result, rpt)
-		log.Println(strings.Join(rpt.Show(), "\n"))
+// runStage runs the operators of a stage in order, or in parallel if enabled
+func runStage(ctx context.Context, op *Options, conf operator.Config, project string, factories []operator.Factory, value string, stopping bool) ([]*model.Report, error) {
+	reports := make([]*model.Report, len(factories))
+	errs := make([]error, len(factories))
+
+	run := func(i int) {
+		o := factories[i](ctx, project, conf).Filter(Label, value)
+		if stopping {
+			reports[i], errs[i] = o.Stop()
+		} else {
+			reports[i], errs[i] = o.Start()
+		}
+		if errs[i] != nil {
+			if stopping {
+				log.Printf("Some error occured in stopping %v in %v: %v", o.Name(), project, errs[i])
+			} else {
+				log.Printf("Some error occurred in starting %v in %v: %v\n", o.Name(), project, errs[i])
+			}
+		}
+		if reports[i] == nil && ctx.Err() != nil {
+			// the deadline hit before listing the resources
+			reports[i] = &model.Report{InstanceType: o.Name(), DryRun: conf.DryRun, Partial: true}
+		}
+		if reports[i] != nil {
+			reports[i].Project = project
+			reports[i].Schedule = value
+			log.Printf("Project(%v)\n%v", project, strings.Join(reports[i].Show(), "\n"))
+		}
 	}
 
-	rpt, err = operator.InstanceGroup(ctx, projectID).Filter(Label, "true").Recovery()
-	if err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Some error occurred in starting instances group: %v\n", err)
+	if op.Parallel {
+		var wg sync.WaitGroup
+		for i := range factories {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				run(i)
+			}(i)
+		}
+		wg.Wait()
 	} else {
-		result = append(result, rpt)
-		log.Println(strings.Join(rpt.Show(), "\n"))
+		for i := range factories {
+			run(i)
+		}
 	}
 
-	rpt, err = operator.GKENodePool(ctx, projectID).Filter(Label, "true").Recovery()
-	if err != nil {
-		errorLog = multierror.Append(errorLog, err)
-		log.Printf("Some error occurred in starting gke node pool: %v\n", err)
-	} else {
-		result = append(result, rpt)
-		log.Println(strings.Join(rpt.Show(), "\n"))
+	var errorLog error
+	var result []*model.Report
+	for i := range factories {
+		if errs[i] != nil {
+			errorLog = multierror.Append(errorLog, errs[i])
+		}
+		if reports[i] != nil {
+			result = append(result, reports[i])
+		}
 	}
+	return result, errorLog
+}
+
+// interrupted returns the error if ctx is done. the remaining stages are not run
+func interrupted(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Interrupted: %v. the remaining operators are not run", err)
+		return err
+	}
+	return nil
+}
 
+// post reports to slack if enabled
+func notify(op *Options, command string, projects []string, result []*model.Report, errorLog error) error {
 	if !op.SlackEnable {
 		log.Printf("done.")
 		return errorLog
 	}
 
-	_, err = report.NewSlackNotifier(op.SlackToken, op.SlackChannel).Post(report.Report{
-		ProjectID: projectID,
-		Reports:   result,
-		Command:   "Restart",
+	_, err := report.NewSlackNotifier(op.SlackToken, op.SlackChannel).Post(report.Report{
+		ProjectIDs: projects,
+		Reports:    result,
+		Command:    command,
 	})
 	if err != nil {
 		log.Println("error in Slack notification:", err)
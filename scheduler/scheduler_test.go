@@ -0,0 +1,71 @@
+/**
+ * Copyright (c) 2019-present Future Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/future-architect/gcp-instance-scheduler/schedule"
+)
+
+func TestSkipReason(t *testing.T) {
+	c, err := schedule.Parse([]byte(`
+calendar: holidays
+calendars:
+  - name: holidays
+    dates: ["2026-11-03", "2026-11-23"]
+exceptions:
+  - from: "2026-11-03"
+    running: true
+  - from: "2026-11-05"
+    running: false
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &Options{Schedules: c}
+
+	tests := []struct {
+		name    string
+		date    string
+		running bool
+		want    string
+	}{
+		{"restart on workday", "2026-11-04", true, ""},
+		{"restart on holiday", "2026-11-23", true, "holiday of calendar holidays"},
+		{"restart on holiday in running exception", "2026-11-03", true, ""},
+		{"restart in stopped exception", "2026-11-05", true, "exception from 2026-11-05"},
+		{"stop on holiday", "2026-11-23", false, ""},
+		{"stop in running exception", "2026-11-03", false, "exception from 2026-11-03"},
+		{"stop in stopped exception", "2026-11-05", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.Parse("2006-01-02 15:04", tt.date+" 10:00")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := op.skipReason(now, tt.running); got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := (&Options{}).skipReason(time.Now(), true); got != "" {
+		t.Errorf("skipReason() without config = %q", got)
+	}
+}